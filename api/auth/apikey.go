@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// APIKeyHeader carries a caller's API key.
+const APIKeyHeader = "X-API-Key"
+
+// apiKey is an entry of an API keys file. Only the key's SHA-256 hash is
+// stored, so the file doesn't hold the keys themselves.
+type apiKey struct {
+	Name      string   `yaml:"name"`
+	KeySHA256 string   `yaml:"key_sha256"`
+	Roles     []string `yaml:"roles"`
+}
+
+// APIKeys authenticates callers by a static API key sent in the X-API-Key
+// header.
+type APIKeys struct {
+	// byHash holds the principal of each key, by its hex encoded SHA-256
+	// hash.
+	byHash map[string]*principal.Principal
+}
+
+// LoadAPIKeys loads the API keys from a YAML file, a list of keys each with
+// a name, the hex encoded SHA-256 hash of the key (key_sha256) and roles.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading API keys: %w", err)
+	}
+
+	var keys []apiKey
+	if err := yaml.UnmarshalStrict(b, &keys); err != nil {
+		return nil, fmt.Errorf("parsing API keys %s: %w", path, err)
+	}
+
+	a := &APIKeys{byHash: make(map[string]*principal.Principal, len(keys))}
+
+	for i, key := range keys {
+		hash := strings.ToLower(key.KeySHA256)
+
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key %d in %s has no name", i, path)
+		}
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("API key %q in %s has an invalid key_sha256", key.Name, path)
+		}
+		if _, ok := a.byHash[hash]; ok {
+			return nil, fmt.Errorf("API key %q in %s duplicates another key", key.Name, path)
+		}
+
+		a.byHash[hash] = &principal.Principal{Subject: key.Name, Method: "api_key", Roles: key.Roles}
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the principal of the request's API key.
+func (a *APIKeys) Authenticate(r *http.Request) (*principal.Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+
+	// Keys are looked up by their hash, so the lookup's timing reveals
+	// nothing of the keys themselves.
+	sum := sha256.Sum256([]byte(key))
+
+	p, ok := a.byHash[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,36 @@
+// Package auth authenticates the API gateway's callers, and forwards who they
+// are to the services as gRPC metadata.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when a request's
+// credentials are not valid, such as an expired token or unknown API key.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator authenticates a request's caller by one method. It returns a
+// nil principal, and no error, when the request carries no credentials of its
+// kind, so other methods may be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*principal.Principal, error)
+}
+
+// Metadata forwards the principal of a request to the services. It's
+// installed on the gateway mux with runtime.WithMetadata. Anonymous requests
+// are forwarded without any.
+func Metadata(_ context.Context, r *http.Request) metadata.MD {
+	p, ok := principal.FromContext(r.Context())
+	if !ok {
+		return nil
+	}
+
+	return p.Metadata()
+}
@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/config"
+)
+
+func TestLoadJWTKeys(t *testing.T) {
+	keys := newTestKeys(t)
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	// with returns a JWK changed by the given parameters.
+	with := func(jwk map[string]string, changes map[string]string) map[string]string {
+		changed := make(map[string]string, len(jwk))
+		for k, v := range jwk {
+			changed[k] = v
+		}
+		for k, v := range changes {
+			changed[k] = v
+		}
+		return changed
+	}
+
+	rsaKey := rsaJWK("rsa", "", &keys.rsaKey.PublicKey)
+	ecKey := ecJWK("ec", &keys.ecKey.PublicKey)
+
+	for _, tc := range []struct {
+		name string
+		keys []interface{}
+		// wantErr is part of the error expected, or empty when the keys
+		// should load.
+		wantErr string
+	}{
+		{"RSA and EC keys", []interface{}{rsaKey, ecKey}, ""},
+		{"encryption keys skipped", []interface{}{rsaKey, with(ecKey, map[string]string{"use": "enc", "crv": "P-0"})}, ""},
+		{"unknown key types skipped", []interface{}{rsaKey, map[string]string{"kty": "oct", "k": "c2VjcmV0"}}, ""},
+		{"no keys", nil, "no RSA or EC signing keys"},
+		{"only encryption keys", []interface{}{with(rsaKey, map[string]string{"use": "enc"})}, "no RSA or EC signing keys"},
+		{"only symmetric keys", []interface{}{map[string]string{"kty": "oct", "k": "c2VjcmV0"}}, "no RSA or EC signing keys"},
+		{"RSA key under 2048 bits", []interface{}{rsaJWK("small", "", &smallKey.PublicKey)}, "smaller than 2048 bits"},
+		{"RSA modulus missing", []interface{}{with(rsaKey, map[string]string{"n": ""})}, "invalid modulus"},
+		{"RSA modulus not base64url", []interface{}{with(rsaKey, map[string]string{"n": "!!"})}, "invalid modulus"},
+		{"RSA exponent of 1", []interface{}{with(rsaKey, map[string]string{"e": "AQ"})}, "invalid exponent"},
+		{"RSA exponent too large", []interface{}{with(rsaKey, map[string]string{"e": "AQAAAAAB"})}, "invalid exponent"},
+		{"unsupported curve", []interface{}{with(ecKey, map[string]string{"crv": "secp256k1"})}, "unsupported curve"},
+		{"EC point off the curve", []interface{}{with(ecKey, map[string]string{"y": ecKey["x"]})}, "not on the curve"},
+		{"EC point of another curve", []interface{}{with(ecKey, map[string]string{"crv": "P-384"})}, "not on the curve"},
+		{"EC x missing", []interface{}{with(ecKey, map[string]string{"x": ""})}, "invalid x"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := auth.LoadJWT(config.Auth{JWKSFile: writeJWKS(t, tc.keys...)})
+
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("LoadJWT = %v, want no error", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("LoadJWT = %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadJWTFiles(t *testing.T) {
+	if _, err := auth.LoadJWT(config.Auth{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("LoadJWT of a missing file succeeded, want an error")
+	}
+
+	if _, err := auth.LoadJWT(config.Auth{JWKSFile: writeJWKS(t, "not a key")}); err == nil {
+		t.Error("LoadJWT of a malformed file succeeded, want an error")
+	}
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	// Register the hashes tokens are signed with.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// clockSkew is how far the gateway's clock may differ from the token
+// issuer's when checking a token's expiry and not-before times.
+const clockSkew = time.Minute
+
+// algorithm is a JWS signature algorithm tokens may be signed with.
+type algorithm struct {
+	hash crypto.Hash
+	// family is the kind of key the algorithm signs with: "RS", "PS" or
+	// "ES".
+	family string
+}
+
+// algorithms are the signature algorithms accepted. Symmetric algorithms and
+// "none" aren't, so a public key can never be used as a shared secret.
+var algorithms = map[string]algorithm{
+	"RS256": {crypto.SHA256, "RS"},
+	"RS384": {crypto.SHA384, "RS"},
+	"RS512": {crypto.SHA512, "RS"},
+	"PS256": {crypto.SHA256, "PS"},
+	"PS384": {crypto.SHA384, "PS"},
+	"PS512": {crypto.SHA512, "PS"},
+	"ES256": {crypto.SHA256, "ES"},
+	"ES384": {crypto.SHA384, "ES"},
+	"ES512": {crypto.SHA512, "ES"},
+}
+
+// JWT authenticates callers by a JSON Web Token sent as a bearer token in the
+// Authorization header, signed by one of the keys of a JWKS file.
+type JWT struct {
+	keys       []verificationKey
+	issuer     string
+	audience   string
+	rolesClaim string
+}
+
+// LoadJWT loads the keys tokens are verified against from cfg.JWKSFile.
+// Tokens must be issued by cfg.Issuer and for cfg.Audience, when set.
+func LoadJWT(cfg config.Auth) (*JWT, error) {
+	keys, err := loadJWKS(cfg.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWT{
+		keys:       keys,
+		issuer:     cfg.Issuer,
+		audience:   cfg.Audience,
+		rolesClaim: cfg.RolesClaim,
+	}, nil
+}
+
+// Authenticate returns the principal of the request's bearer token.
+func (j *JWT) Authenticate(r *http.Request) (*principal.Principal, error) {
+	const scheme = "bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return nil, nil
+	}
+
+	p, err := j.verify(strings.TrimSpace(header[len(scheme):]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+	}
+
+	return p, nil
+}
+
+// verify checks a token's signature and claims, returning its principal.
+func (j *JWT) verify(token string) (*principal.Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	// No extensions are understood, so tokens requiring any are rejected.
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("unsupported critical headers %v", header.Crit)
+	}
+
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	if !j.verifySignature(header.Kid, header.Alg, alg, parts[0]+"."+parts[1], sig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	return j.checkClaims(claims)
+}
+
+// verifySignature reports whether sig is the signature of signed by any of
+// the keys the token may be signed with: the key it names, if any, of the
+// family of its algorithm.
+func (j *JWT) verifySignature(kid, algName string, alg algorithm, signed string, sig []byte) bool {
+	h := alg.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	for _, k := range j.keys {
+		if kid != "" && k.id != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != algName {
+			continue
+		}
+
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			switch alg.family {
+			case "RS":
+				if rsa.VerifyPKCS1v15(key, alg.hash, digest, sig) == nil {
+					return true
+				}
+			case "PS":
+				if rsa.VerifyPSS(key, alg.hash, digest, sig, nil) == nil {
+					return true
+				}
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+
+			if alg.family != "ES" || len(sig) != 2*size {
+				continue
+			}
+
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkClaims checks a token is current and meant for the gateway, and reads
+// its principal.
+func (j *JWT) checkClaims(claims map[string]interface{}) (*principal.Principal, error) {
+	now := time.Now()
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return nil, fmt.Errorf("token issuer %q is not trusted", iss)
+		}
+	}
+
+	if j.audience != "" && !hasAudience(claims["aud"], j.audience) {
+		return nil, errors.New("token is not meant for this audience")
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &principal.Principal{Subject: sub, Method: "jwt", Roles: roles(claims[j.rolesClaim])}, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+// numericClaim reads a claim holding seconds since the epoch.
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(f), 0), true
+}
+
+// hasAudience reports whether an aud claim, a string or array of strings,
+// holds the audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// roles reads a roles claim, either an array of strings or a space separated
+// string, as in OAuth scopes.
+func roles(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		var roles []string
+
+		for _, r := range claim {
+			if s, ok := r.(string); ok && s != "" {
+				roles = append(roles, s)
+			}
+		}
+
+		return roles
+	}
+
+	return nil
+}
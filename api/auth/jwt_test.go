@@ -0,0 +1,377 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "racing"
+)
+
+// testKeys are the keys tokens are signed with in the tests. The JWKS the
+// tokens are verified against holds rsaKey as "rsa", psKey as "ps", limited to
+// PS256, and ecKey as "ec"; otherKey is in no JWKS.
+type testKeys struct {
+	rsaKey, psKey, otherKey *rsa.PrivateKey
+	ecKey                   *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+
+	newRSA := func() *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generating RSA key: %v", err)
+		}
+		return key
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating EC key: %v", err)
+	}
+
+	return testKeys{rsaKey: newRSA(), psKey: newRSA(), otherKey: newRSA(), ecKey: ecKey}
+}
+
+// writeJWKS writes a JWKS file of keys, returning its path.
+func writeJWKS(t *testing.T, keys ...interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatalf("marshalling JWKS: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("writing JWKS: %v", err)
+	}
+
+	return path
+}
+
+func rsaJWK(kid, alg string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": alg,
+		"n":   encode(key.N.Bytes()),
+		"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": key.Curve.Params().Name,
+		"x":   encode(key.X.Bytes()),
+		"y":   encode(key.Y.Bytes()),
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signer signs a token's header and claims, returning its signature.
+type signer func(t *testing.T, signed []byte) []byte
+
+func signRS(key *rsa.PrivateKey) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return sig
+	}
+}
+
+func signPS(key *rsa.PrivateKey) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return sig
+	}
+}
+
+// signES signs as ES256 does, with r and s each padded to size bytes.
+func signES(key *ecdsa.PrivateKey, size int) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+
+		return sig
+	}
+}
+
+// signESASN1 signs with the ASN.1 DER encoding of r and s, as crypto/ecdsa
+// does, rather than as JWS requires.
+func signESASN1(key *ecdsa.PrivateKey) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return sig
+	}
+}
+
+func signHS(secret []byte) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func unsigned(t *testing.T, signed []byte) []byte {
+	return nil
+}
+
+// tamper changes a signer's signature, flipping a bit of its last byte.
+func tamper(sign signer) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		sig := sign(t, signed)
+		sig[len(sig)-1] ^= 1
+		return sig
+	}
+}
+
+// resize changes the length of a signer's signature by delta bytes, trimming
+// bytes from its end or prepending zeros.
+func resize(sign signer, delta int) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		sig := sign(t, signed)
+		if delta < 0 {
+			return sig[:len(sig)+delta]
+		}
+		return append(make([]byte, delta), sig...)
+	}
+}
+
+// token builds a signed token.
+func token(t *testing.T, header, claims map[string]interface{}, sign signer) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshalling header: %v", err)
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshalling claims: %v", err)
+	}
+
+	signed := encode(h) + "." + encode(c)
+
+	return signed + "." + encode(sign(t, []byte(signed)))
+}
+
+// validClaims returns claims the tests' verifier accepts, changed by the
+// given claims, where nil values remove a claim.
+func validClaims(changes map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+
+	claims := map[string]interface{}{
+		"sub":   "alice",
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Hour).Unix(),
+		"roles": []string{"trader"},
+	}
+
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+
+	return claims
+}
+
+func header(alg, kid string) map[string]interface{} {
+	h := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		h["kid"] = kid
+	}
+	return h
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys := newTestKeys(t)
+
+	jwt, err := auth.LoadJWT(config.Auth{
+		JWKSFile: writeJWKS(t,
+			rsaJWK("rsa", "", &keys.rsaKey.PublicKey),
+			rsaJWK("ps", "PS256", &keys.psKey.PublicKey),
+			ecJWK("ec", &keys.ecKey.PublicKey),
+		),
+		Issuer:     testIssuer,
+		Audience:   testAudience,
+		RolesClaim: "roles",
+	})
+	if err != nil {
+		t.Fatalf("LoadJWT: %v", err)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&keys.rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshalling public key: %v", err)
+	}
+
+	// An ASN.1 DER signature, shorter than ES256 signatures are.
+	derSig, err := asn1.Marshal(struct{ R, S *big.Int }{big.NewInt(1), big.NewInt(1)})
+	if err != nil {
+		t.Fatalf("marshalling signature: %v", err)
+	}
+
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		// valid is set when the token should be accepted.
+		valid bool
+	}{
+		{"RS256", token(t, header("RS256", "rsa"), validClaims(nil), signRS(keys.rsaKey)), true},
+		{"RS256 without kid", token(t, header("RS256", ""), validClaims(nil), signRS(keys.rsaKey)), true},
+		{"PS256", token(t, header("PS256", "ps"), validClaims(nil), signPS(keys.psKey)), true},
+		{"PS256 of unrestricted key", token(t, header("PS256", "rsa"), validClaims(nil), signPS(keys.rsaKey)), true},
+		{"ES256", token(t, header("ES256", "ec"), validClaims(nil), signES(keys.ecKey, 32)), true},
+		{"ES256 without kid", token(t, header("ES256", ""), validClaims(nil), signES(keys.ecKey, 32)), true},
+
+		{"tampered RS256", token(t, header("RS256", "rsa"), validClaims(nil), tamper(signRS(keys.rsaKey))), false},
+		{"tampered PS256", token(t, header("PS256", "ps"), validClaims(nil), tamper(signPS(keys.psKey))), false},
+		{"tampered ES256", token(t, header("ES256", "ec"), validClaims(nil), tamper(signES(keys.ecKey, 32))), false},
+		{"ES256 signature too short", token(t, header("ES256", "ec"), validClaims(nil), resize(signES(keys.ecKey, 32), -1)), false},
+		{"ES256 signature too long", token(t, header("ES256", "ec"), validClaims(nil), resize(signES(keys.ecKey, 32), 1)), false},
+		{"ES256 signature of the wrong curve size", token(t, header("ES256", "ec"), validClaims(nil), signES(keys.ecKey, 48)), false},
+		{"ES256 signature in ASN.1", token(t, header("ES256", "ec"), validClaims(nil), signESASN1(keys.ecKey)), false},
+		{"ES256 signature in short ASN.1", token(t, header("ES256", "ec"), validClaims(nil), func(*testing.T, []byte) []byte { return derSig }), false},
+		{"empty signature", token(t, header("RS256", "rsa"), validClaims(nil), unsigned), false},
+		{"signed by an unknown key", token(t, header("RS256", ""), validClaims(nil), signRS(keys.otherKey)), false},
+
+		{"alg none", token(t, header("none", ""), validClaims(nil), unsigned), false},
+		{"alg none with kid", token(t, header("none", "rsa"), validClaims(nil), unsigned), false},
+		{"alg none with signature", token(t, header("none", "rsa"), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"alg missing", token(t, map[string]interface{}{"kid": "rsa"}, validClaims(nil), signRS(keys.rsaKey)), false},
+		{"HS256 keyed with the RSA public key", token(t, header("HS256", "rsa"), validClaims(nil), signHS(publicKey)), false},
+		{"HS256 keyed with the RSA modulus", token(t, header("HS256", "rsa"), validClaims(nil), signHS(keys.rsaKey.N.Bytes())), false},
+
+		{"RS256 with EC key", token(t, header("RS256", "ec"), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"ES256 with RSA key", token(t, header("ES256", "rsa"), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"ES256 signed by RSA key", token(t, header("ES256", ""), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"RS256 signed as PS256", token(t, header("RS256", "rsa"), validClaims(nil), signPS(keys.rsaKey)), false},
+		{"PS256 signed as RS256", token(t, header("PS256", "rsa"), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"RS256 with key limited to PS256", token(t, header("RS256", "ps"), validClaims(nil), signRS(keys.psKey)), false},
+		{"RS384 signed with SHA-256", token(t, header("RS384", "rsa"), validClaims(nil), signRS(keys.rsaKey)), false},
+
+		{"unknown kid", token(t, header("RS256", "unknown"), validClaims(nil), signRS(keys.rsaKey)), false},
+		{"kid of another key", token(t, header("RS256", "ps"), validClaims(nil), signRS(keys.rsaKey)), false},
+
+		{"expired", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}), signRS(keys.rsaKey)), false},
+		{"expired within clock skew", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), signRS(keys.rsaKey)), true},
+		{"no expiry", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"exp": nil}), signRS(keys.rsaKey)), false},
+		{"non-numeric expiry", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"exp": "never"}), signRS(keys.rsaKey)), false},
+		{"not yet valid", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}), signRS(keys.rsaKey)), false},
+		{"not yet valid within clock skew", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}), signRS(keys.rsaKey)), true},
+		{"no not-before", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"nbf": nil}), signRS(keys.rsaKey)), true},
+
+		{"wrong issuer", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"iss": "https://other.example"}), signRS(keys.rsaKey)), false},
+		{"no issuer", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"iss": nil}), signRS(keys.rsaKey)), false},
+		{"wrong audience", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"aud": "sports"}), signRS(keys.rsaKey)), false},
+		{"no audience", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"aud": nil}), signRS(keys.rsaKey)), false},
+		{"audience among several", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"aud": []string{"sports", testAudience}}), signRS(keys.rsaKey)), true},
+		{"audience not among several", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"aud": []string{"sports", "betting"}}), signRS(keys.rsaKey)), false},
+		{"no subject", token(t, header("RS256", "rsa"), validClaims(map[string]interface{}{"sub": nil}), signRS(keys.rsaKey)), false},
+
+		{"critical header", token(t, map[string]interface{}{"alg": "RS256", "kid": "rsa", "crit": []string{"exp"}}, validClaims(nil), signRS(keys.rsaKey)), false},
+		{"two segments", "e30.e30", false},
+		{"four segments", "e30.e30.e30.e30", false},
+		{"header not base64url", "!!.e30.", false},
+		{"header not JSON", encode([]byte("{")) + ".e30.", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/races", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+
+			p, err := jwt.Authenticate(r)
+
+			if !tc.valid {
+				if !errors.Is(err, auth.ErrInvalidCredentials) {
+					t.Errorf("Authenticate = %v, %v, want ErrInvalidCredentials", p, err)
+				}
+				return
+			}
+
+			want := &principal.Principal{Subject: "alice", Method: "jwt", Roles: []string{"trader"}}
+			if err != nil || !reflect.DeepEqual(p, want) {
+				t.Errorf("Authenticate = %+v, %v, want %+v", p, err, want)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticateWithoutBearerToken(t *testing.T) {
+	keys := newTestKeys(t)
+
+	jwt, err := auth.LoadJWT(config.Auth{JWKSFile: writeJWKS(t, rsaJWK("rsa", "", &keys.rsaKey.PublicKey))})
+	if err != nil {
+		t.Fatalf("LoadJWT: %v", err)
+	}
+
+	for _, authorization := range []string{"", "Basic YWxpY2U6c2VjcmV0", "Bearer"} {
+		r := httptest.NewRequest("GET", "/v1/races", nil)
+		r.Header.Set("Authorization", authorization)
+
+		if p, err := jwt.Authenticate(r); p != nil || err != nil {
+			t.Errorf("Authenticate with Authorization %q = %v, %v, want neither principal nor error", authorization, p, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package certs provides the API gateway's TLS credentials, from the
+// certificates and CAs it's configured with. They're reloaded when their
+// files change, so they can be rotated without a restart.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"git.neds.sh/matty/entain/api/config"
+	sharedcerts "git.neds.sh/matty/entain/shared/certs"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServerConfig returns the HTTP server's TLS configuration, or nil when TLS is
+// disabled.
+func ServerConfig(cfg config.TLS) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	keyPair, err := sharedcerts.LoadKeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return keyPair.Certificate(), nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// UpstreamCredentials returns the credentials the racing service is dialled
+// with, or nil when it's dialled in plaintext. The gateway presents its
+// client certificate, when configured, for mutual TLS.
+func UpstreamCredentials(cfg config.UpstreamTLS) (credentials.TransportCredentials, error) {
+	if cfg.CAFile == "" {
+		return nil, nil
+	}
+
+	rootCAs, err := sharedcerts.LoadCAPool(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPair *sharedcerts.KeyPair
+	if cfg.CertFile != "" {
+		if keyPair, err = sharedcerts.LoadKeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &clientCredentials{
+		config: func() *tls.Config {
+			c := &tls.Config{
+				RootCAs:    rootCAs.Pool(),
+				MinVersion: tls.VersionTLS12,
+			}
+
+			if keyPair != nil {
+				c.Certificates = []tls.Certificate{*keyPair.Certificate()}
+			}
+
+			return c
+		},
+		serverName: cfg.ServerName,
+	}, nil
+}
+
+// clientCredentials handshakes with the TLS configuration current at the
+// time, so rotated CAs and certificates are used by new connections.
+type clientCredentials struct {
+	config     func() *tls.Config
+	serverName string
+}
+
+func (c *clientCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	config := c.config()
+	config.ServerName = c.serverName
+
+	return credentials.NewTLS(config).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *clientCredentials) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("certs: client credentials can't be used by servers")
+}
+
+func (c *clientCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2", ServerName: c.serverName}
+}
+
+func (c *clientCredentials) Clone() credentials.TransportCredentials {
+	return &clientCredentials{config: c.config, serverName: c.serverName}
+}
+
+func (c *clientCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+
+	return nil
+}
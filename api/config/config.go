@@ -0,0 +1,440 @@
+// Package config loads the API gateway's configuration. Settings are read
+// from a YAML file, then environment variables, then flags, each taking
+// precedence over the last.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variable of every setting. A setting's
+// variable is named after its flag, e.g. API_API_ENDPOINT.
+const envPrefix = "API_"
+
+// Config is the API gateway's configuration.
+type Config struct {
+	// APIEndpoint is the address the HTTP server listens on.
+	APIEndpoint string `yaml:"api_endpoint"`
+	// GRPCEndpoint is the address of the racing service.
+	GRPCEndpoint string `yaml:"grpc_endpoint"`
+	// SportsGRPCEndpoint is the address of the sports service.
+	SportsGRPCEndpoint string `yaml:"sports_grpc_endpoint"`
+	// AdminEndpoint is the address the admin HTTP server, which serves
+	// /metrics, listens on. It's disabled when empty.
+	AdminEndpoint string `yaml:"admin_endpoint"`
+	// ReadHeaderTimeout bounds how long a client may take to send a
+	// request's headers.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// IdleTimeout bounds how long an idle keep-alive connection is kept.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout bounds how long in-flight requests are given to
+	// finish once the gateway is asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadinessTimeout bounds how long /readyz waits on the services' health
+	// checks.
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+	// LogLevel is the minimum level logged, e.g. "info".
+	LogLevel string `yaml:"log_level"`
+	// LogFormat is json, for log aggregation, or text, for reading in a
+	// terminal.
+	LogFormat string `yaml:"log_format"`
+
+	TLS         TLS         `yaml:"tls"`
+	UpstreamTLS UpstreamTLS `yaml:"upstream_tls"`
+	Tracing     Tracing     `yaml:"tracing"`
+	Auth        Auth        `yaml:"auth"`
+	RateLimit   RateLimit   `yaml:"rate_limit"`
+	Cache       Cache       `yaml:"cache"`
+}
+
+// TLS configures the HTTP server's certificate. TLS is disabled when no
+// certificate is given. The files are reloaded when they change.
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// UpstreamTLS configures how the racing service is dialled. Plaintext is
+// used when no CA is given. The files are reloaded when they change.
+type UpstreamTLS struct {
+	// CAFile holds the CA certificates the service's certificate is verified
+	// against.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate the gateway presents,
+	// for mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName overrides the name the service's certificate is verified
+	// against, which is otherwise the host of grpc_endpoint.
+	ServerName string `yaml:"server_name"`
+}
+
+// Auth configures how callers are authenticated. Callers without
+// credentials are served anonymously; those with invalid credentials are
+// refused.
+type Auth struct {
+	// JWKSFile holds the keys JWT bearer tokens are verified against. JWTs
+	// aren't accepted when empty.
+	JWKSFile string `yaml:"jwks_file"`
+	// Issuer, when set, is the only issuer (iss) tokens are accepted from.
+	Issuer string `yaml:"issuer"`
+	// Audience, when set, must be among a token's audiences (aud).
+	Audience string `yaml:"audience"`
+	// RolesClaim is the token claim holding the caller's roles.
+	RolesClaim string `yaml:"roles_claim"`
+	// APIKeysFile lists the API keys accepted, by the SHA-256 hash of each.
+	// API keys aren't accepted when empty.
+	APIKeysFile string `yaml:"api_keys_file"`
+}
+
+// RateLimit configures how often each client may call each route, by token
+// buckets. Clients are identified by their principal when authenticated, and
+// by their IP address otherwise.
+type RateLimit struct {
+	// Store holds the buckets: none, disabling rate limiting, memory, or
+	// redis, sharing them between gateways.
+	Store string `yaml:"store"`
+	// Default is the limit of routes not given their own.
+	Default Limit `yaml:"default"`
+	// Routes holds the limits of routes, named after the RPC they're
+	// forwarded to, e.g. /racing.Racing/ListRaces.
+	Routes map[string]Limit `yaml:"routes"`
+	// ClientIPHeader, when set, is the header a trusted proxy passes the
+	// client's IP address in, e.g. X-Real-IP. The address of the connection
+	// is used otherwise.
+	ClientIPHeader string `yaml:"client_ip_header"`
+	// FailClosed refuses calls when the store fails, rather than letting
+	// them through.
+	FailClosed bool `yaml:"fail_closed"`
+
+	Redis Redis `yaml:"redis"`
+}
+
+// Limit is the rate limit of a route.
+type Limit struct {
+	// RequestsPerSecond is the rate a client's bucket refills at. Zero is
+	// unlimited.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the size of a client's bucket: the most requests they may
+	// make at once.
+	Burst int `yaml:"burst"`
+}
+
+// Redis configures the Redis-compatible server rate limits are stored in.
+type Redis struct {
+	Address   string `yaml:"address"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// Cache configures how long clients may cache race lists and races before
+// revalidating them by their ETag.
+type Cache struct {
+	// MaxAge is the longest a response may be cached for. Responses holding
+	// a race that's yet to start are cached no longer than until it starts.
+	// Zero has clients revalidate every time.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Tracing configures how trace spans are exported. Its fields must match
+// those of the shared tracing.Config, which it's converted to.
+type Tracing struct {
+	// Exporter is none, otlp, stdout or file.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector spans are sent to over
+	// gRPC, for the otlp exporter.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans to the collector in plaintext.
+	Insecure bool `yaml:"insecure"`
+	// File is the file spans are appended to, for the file exporter.
+	File string `yaml:"file"`
+	// SampleRatio is the fraction of new traces sampled, from 0 to 1. Traces
+	// begun by a caller follow the caller's sampling decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Default returns the configuration used where nothing else is set.
+func Default() Config {
+	return Config{
+		APIEndpoint:        "localhost:8000",
+		GRPCEndpoint:       "localhost:9000",
+		SportsGRPCEndpoint: "localhost:9001",
+		AdminEndpoint:      "localhost:8090",
+		ReadHeaderTimeout:  5 * time.Second,
+		IdleTimeout:        2 * time.Minute,
+		ShutdownTimeout:    15 * time.Second,
+		ReadinessTimeout:   2 * time.Second,
+		LogLevel:           "info",
+		LogFormat:          "json",
+		Tracing: Tracing{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			SampleRatio: 1,
+		},
+		Auth: Auth{
+			RolesClaim: "roles",
+		},
+		RateLimit: RateLimit{
+			Store:   "memory",
+			Default: Limit{RequestsPerSecond: 10, Burst: 20},
+			Redis: Redis{
+				Address:   "localhost:6379",
+				KeyPrefix: "ratelimit:",
+			},
+		},
+		Cache: Cache{
+			MaxAge: time.Minute,
+		},
+	}
+}
+
+// Load builds the configuration from the command line arguments, the
+// environment, and the YAML file named by --config or API_CONFIG, if any.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	file := fs.String("config", "", "YAML configuration file")
+
+	fs.StringVar(&cfg.APIEndpoint, "api-endpoint", cfg.APIEndpoint, "API endpoint")
+	fs.StringVar(&cfg.GRPCEndpoint, "grpc-endpoint", cfg.GRPCEndpoint, "gRPC server endpoint")
+	fs.StringVar(&cfg.SportsGRPCEndpoint, "sports-grpc-endpoint", cfg.SportsGRPCEndpoint, "Sports gRPC server endpoint")
+	fs.StringVar(&cfg.AdminEndpoint, "admin-endpoint", cfg.AdminEndpoint, "Admin HTTP server endpoint, serving /metrics (empty to disable)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout, "Time allowed to read a request's headers")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "Time an idle keep-alive connection is kept open")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Time in-flight requests are given to finish on shutdown")
+	fs.DurationVar(&cfg.ReadinessTimeout, "readiness-timeout", cfg.ReadinessTimeout, "Time /readyz waits on the services' health checks")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Minimum level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: json or text")
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert-file", cfg.TLS.CertFile, "TLS certificate file of the HTTP server")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key-file", cfg.TLS.KeyFile, "TLS key file of the HTTP server")
+	fs.StringVar(&cfg.UpstreamTLS.CAFile, "upstream-tls-ca-file", cfg.UpstreamTLS.CAFile, "CA file the racing gRPC server's certificate is verified against (plaintext if unset)")
+	fs.StringVar(&cfg.UpstreamTLS.CertFile, "upstream-tls-cert-file", cfg.UpstreamTLS.CertFile, "TLS client certificate file presented to the racing gRPC server")
+	fs.StringVar(&cfg.UpstreamTLS.KeyFile, "upstream-tls-key-file", cfg.UpstreamTLS.KeyFile, "TLS client key file presented to the racing gRPC server")
+	fs.StringVar(&cfg.UpstreamTLS.ServerName, "upstream-tls-server-name", cfg.UpstreamTLS.ServerName, "Name the racing gRPC server's certificate is verified against, if not its host")
+	fs.StringVar(&cfg.Tracing.Exporter, "tracing-exporter", cfg.Tracing.Exporter, "Where trace spans are exported: none, otlp, stdout or file")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "OTLP gRPC collector endpoint, for the otlp exporter")
+	fs.BoolVar(&cfg.Tracing.Insecure, "tracing-insecure", cfg.Tracing.Insecure, "Send spans to the OTLP collector in plaintext")
+	fs.StringVar(&cfg.Tracing.File, "tracing-file", cfg.Tracing.File, "File trace spans are appended to, for the file exporter")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "tracing-sample-ratio", cfg.Tracing.SampleRatio, "Fraction of new traces sampled, from 0 to 1")
+	fs.StringVar(&cfg.Auth.JWKSFile, "auth-jwks-file", cfg.Auth.JWKSFile, "JWKS file JWT bearer tokens are verified against (JWTs not accepted if unset)")
+	fs.StringVar(&cfg.Auth.Issuer, "auth-issuer", cfg.Auth.Issuer, "Issuer JWTs must be issued by, if set")
+	fs.StringVar(&cfg.Auth.Audience, "auth-audience", cfg.Auth.Audience, "Audience JWTs must be issued for, if set")
+	fs.StringVar(&cfg.Auth.RolesClaim, "auth-roles-claim", cfg.Auth.RolesClaim, "JWT claim holding the caller's roles")
+	fs.StringVar(&cfg.Auth.APIKeysFile, "auth-api-keys-file", cfg.Auth.APIKeysFile, "YAML file of accepted API keys (API keys not accepted if unset)")
+	fs.StringVar(&cfg.RateLimit.Store, "rate-limit-store", cfg.RateLimit.Store, "Where rate limits are kept: none (disabled), memory or redis")
+	fs.Float64Var(&cfg.RateLimit.Default.RequestsPerSecond, "rate-limit-rps", cfg.RateLimit.Default.RequestsPerSecond, "Requests per second each client may make to a route, by default (0 for unlimited)")
+	fs.IntVar(&cfg.RateLimit.Default.Burst, "rate-limit-burst", cfg.RateLimit.Default.Burst, "Requests each client may make to a route at once, by default")
+	fs.StringVar(&cfg.RateLimit.ClientIPHeader, "rate-limit-client-ip-header", cfg.RateLimit.ClientIPHeader, "Header a trusted proxy passes the client's IP in (the connection's if unset)")
+	fs.BoolVar(&cfg.RateLimit.FailClosed, "rate-limit-fail-closed", cfg.RateLimit.FailClosed, "Refuse calls when the rate limit store fails, rather than allowing them")
+	fs.StringVar(&cfg.RateLimit.Redis.Address, "rate-limit-redis-address", cfg.RateLimit.Redis.Address, "Redis server rate limits are kept in, for the redis store")
+	fs.StringVar(&cfg.RateLimit.Redis.Password, "rate-limit-redis-password", cfg.RateLimit.Redis.Password, "Password of the Redis server")
+	fs.IntVar(&cfg.RateLimit.Redis.DB, "rate-limit-redis-db", cfg.RateLimit.Redis.DB, "Database of the Redis server")
+	fs.StringVar(&cfg.RateLimit.Redis.KeyPrefix, "rate-limit-redis-key-prefix", cfg.RateLimit.Redis.KeyPrefix, "Prefix of the Redis keys rate limits are kept in")
+	fs.DurationVar(&cfg.Cache.MaxAge, "cache-max-age", cfg.Cache.MaxAge, "Longest clients may cache race responses for (0 to always revalidate)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Flags are parsed first to find the config file, so note which were set
+	// to re-apply them over the file and environment.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+
+	if *file == "" {
+		*file = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if *file != "" {
+		if err := loadFile(*file, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// loadFile reads a YAML config file over cfg. Unknown keys are rejected, so
+// typos don't go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv sets each flag from its environment variable, where present.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// Validate checks the configuration is usable, reporting every problem
+// found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	for _, endpoint := range []struct {
+		name, value string
+	}{
+		{"api_endpoint", c.APIEndpoint},
+		{"grpc_endpoint", c.GRPCEndpoint},
+		{"sports_grpc_endpoint", c.SportsGRPCEndpoint},
+	} {
+		if _, _, err := net.SplitHostPort(endpoint.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q is not a host:port address", endpoint.name, endpoint.value))
+		}
+	}
+
+	if c.AdminEndpoint != "" {
+		if _, _, err := net.SplitHostPort(c.AdminEndpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("admin_endpoint %q is not a host:port address", c.AdminEndpoint))
+		}
+	}
+
+	if c.ReadHeaderTimeout < 0 {
+		problems = append(problems, "read_header_timeout must not be negative")
+	}
+
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "idle_timeout must not be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+
+	if c.ReadinessTimeout <= 0 {
+		problems = append(problems, "readiness_timeout must be positive")
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level %q is not a valid level", c.LogLevel))
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		problems = append(problems, fmt.Sprintf("log_format %q is not one of json or text", c.LogFormat))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+
+	if (c.UpstreamTLS.CertFile == "") != (c.UpstreamTLS.KeyFile == "") {
+		problems = append(problems, "upstream_tls.cert_file and upstream_tls.key_file must be set together")
+	}
+
+	if c.UpstreamTLS.CAFile == "" && (c.UpstreamTLS.CertFile != "" || c.UpstreamTLS.ServerName != "") {
+		problems = append(problems, "upstream_tls.cert_file and upstream_tls.server_name require upstream_tls.ca_file")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if _, _, err := net.SplitHostPort(c.Tracing.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("tracing.endpoint %q is not a host:port address", c.Tracing.Endpoint))
+		}
+	case "file":
+		if c.Tracing.File == "" {
+			problems = append(problems, "tracing.file is required by exporter \"file\"")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter %q is not one of none, otlp, stdout or file", c.Tracing.Exporter))
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if c.Auth.JWKSFile != "" && c.Auth.RolesClaim == "" {
+		problems = append(problems, "auth.roles_claim is required by auth.jwks_file")
+	}
+
+	switch c.RateLimit.Store {
+	case "none", "memory":
+	case "redis":
+		if _, _, err := net.SplitHostPort(c.RateLimit.Redis.Address); err != nil {
+			problems = append(problems, fmt.Sprintf("rate_limit.redis.address %q is not a host:port address", c.RateLimit.Redis.Address))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("rate_limit.store %q is not one of none, memory or redis", c.RateLimit.Store))
+	}
+
+	problems = append(problems, c.RateLimit.Default.problems("rate_limit.default")...)
+
+	for route, limit := range c.RateLimit.Routes {
+		problems = append(problems, limit.problems(fmt.Sprintf("rate_limit.routes[%q]", route))...)
+	}
+
+	if c.Cache.MaxAge < 0 {
+		problems = append(problems, "cache.max_age must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// problems reports what's wrong with the limit, named name.
+func (l Limit) problems(name string) []string {
+	var problems []string
+
+	if l.RequestsPerSecond < 0 {
+		problems = append(problems, name+".requests_per_second must not be negative")
+	}
+
+	if l.RequestsPerSecond > 0 && l.Burst < 1 {
+		problems = append(problems, name+".burst must be at least 1")
+	}
+
+	return problems
+}
@@ -0,0 +1,167 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/api/config"
+)
+
+// setEnv sets the environment for a test, having unset every variable of
+// the gateway's, and restores it once the test ends.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	saved := os.Environ()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, kv := range saved {
+			kv := strings.SplitN(kv, "=", 2)
+			os.Setenv(kv[0], kv[1])
+		}
+	})
+
+	for _, kv := range saved {
+		if name := strings.SplitN(kv, "=", 2)[0]; strings.HasPrefix(name, "API_") {
+			os.Unsetenv(name)
+		}
+	}
+
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+}
+
+// writeFile writes a config file for a test, returning its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, "api.yaml", `
+log_level: warn
+shutdown_timeout: 30s
+rate_limit:
+  default:
+    requests_per_second: 5
+    burst: 10
+  routes:
+    /racing.Racing/ListRaces:
+      requests_per_second: 1
+      burst: 2
+`)
+	other := writeFile(t, "other.yaml", "log_level: error\n")
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		// field is the setting checked, which should be want.
+		field func(*config.Config) interface{}
+		want  interface{}
+	}{
+		{"default", nil, nil, logLevel, "info"},
+		{"file", nil, []string{"--config", file}, logLevel, "warn"},
+		{"file named by the environment", map[string]string{"API_CONFIG": file}, nil, logLevel, "warn"},
+		{"file flag over environment", map[string]string{"API_CONFIG": other}, []string{"--config", file}, logLevel, "warn"},
+		{"environment", map[string]string{"API_LOG_LEVEL": "debug"}, nil, logLevel, "debug"},
+		{"environment over file", map[string]string{"API_LOG_LEVEL": "debug"}, []string{"--config", file}, logLevel, "debug"},
+		{"flag", nil, []string{"--log-level", "error"}, logLevel, "error"},
+		{"flag over environment", map[string]string{"API_LOG_LEVEL": "debug"}, []string{"--log-level", "error"}, logLevel, "error"},
+		{"flag over file", nil, []string{"--config", file, "--log-level", "error"}, logLevel, "error"},
+		{"flag set to the default over file", nil, []string{"--config", file, "--log-level", "info"}, logLevel, "info"},
+		{"flag before file flag", map[string]string{"API_LOG_LEVEL": "debug"}, []string{"--log-level", "error", "--config", file}, logLevel, "error"},
+		{"duration from file", nil, []string{"--config", file}, shutdownTimeout, 30 * time.Second},
+		{"duration from environment", map[string]string{"API_SHUTDOWN_TIMEOUT": "1m"}, []string{"--config", file}, shutdownTimeout, time.Minute},
+		{"nested setting from file", nil, []string{"--config", file}, defaultLimit, config.Limit{RequestsPerSecond: 5, Burst: 10}},
+		{"nested setting from environment", map[string]string{"API_RATE_LIMIT_BURST": "15"}, []string{"--config", file}, defaultLimit, config.Limit{RequestsPerSecond: 5, Burst: 15}},
+		{"nested setting from flag", map[string]string{"API_RATE_LIMIT_BURST": "15"}, []string{"--config", file, "--rate-limit-burst", "20", "--rate-limit-rps", "2.5"}, defaultLimit, config.Limit{RequestsPerSecond: 2.5, Burst: 20}},
+		{"setting only in file", map[string]string{"API_RATE_LIMIT_BURST": "15"}, []string{"--config", file}, routes, map[string]config.Limit{"/racing.Racing/ListRaces": {RequestsPerSecond: 1, Burst: 2}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnv(t, tc.env)
+
+			cfg, err := config.Load(tc.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			if got := tc.field(cfg); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("setting = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func logLevel(c *config.Config) interface{}        { return c.LogLevel }
+func shutdownTimeout(c *config.Config) interface{} { return c.ShutdownTimeout }
+func defaultLimit(c *config.Config) interface{}    { return c.RateLimit.Default }
+func routes(c *config.Config) interface{}          { return c.RateLimit.Routes }
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// errs are parts of the error, each of which it should hold.
+		errs []string
+	}{
+		{"missing file", "", nil, []string{"--config", "missing.yaml"}, []string{"reading config file"}},
+		{"unknown file setting", "log_levle: debug\n", nil, nil, []string{"parsing config file", "log_levle"}},
+		{"invalid file setting", "shutdown_timeout: soon\n", nil, nil, []string{"parsing config file"}},
+		{"invalid environment setting", "", map[string]string{"API_SHUTDOWN_TIMEOUT": "soon"}, nil, []string{`invalid value "soon" for API_SHUTDOWN_TIMEOUT`}},
+		{"invalid flag", "", nil, []string{"--shutdown-timeout", "soon"}, []string{"shutdown-timeout"}},
+		{"endpoint", "", nil, []string{"--api-endpoint", "8000"}, []string{`api_endpoint "8000" is not a host:port address`}},
+		{"admin endpoint", "", nil, []string{"--admin-endpoint", "8090"}, []string{`admin_endpoint "8090" is not a host:port address`}},
+		{"shutdown timeout", "", nil, []string{"--shutdown-timeout", "0s"}, []string{"shutdown_timeout must be positive"}},
+		{"log level", "", nil, []string{"--log-level", "loud"}, []string{`log_level "loud" is not a valid level`}},
+		{"log format", "", nil, []string{"--log-format", "xml"}, []string{`log_format "xml" is not one of json or text`}},
+		{"certificate without key", "", nil, []string{"--tls-cert-file", "api.pem"}, []string{"tls.cert_file and tls.key_file must be set together"}},
+		{"upstream certificate without CA", "", nil, []string{"--upstream-tls-cert-file", "api.pem", "--upstream-tls-key-file", "api-key.pem"}, []string{"upstream_tls.cert_file and upstream_tls.server_name require upstream_tls.ca_file"}},
+		{"tracing exporter", "", nil, []string{"--tracing-exporter", "jaeger"}, []string{`tracing.exporter "jaeger" is not one of none, otlp, stdout or file`}},
+		{"tracing file", "", nil, []string{"--tracing-exporter", "file"}, []string{`tracing.file is required by exporter "file"`}},
+		{"sample ratio", "", nil, []string{"--tracing-sample-ratio", "2"}, []string{"tracing.sample_ratio must be between 0 and 1"}},
+		{"roles claim", "", nil, []string{"--auth-jwks-file", "jwks.json", "--auth-roles-claim", ""}, []string{"auth.roles_claim is required by auth.jwks_file"}},
+		{"rate limit store", "", nil, []string{"--rate-limit-store", "disk"}, []string{`rate_limit.store "disk" is not one of none, memory or redis`}},
+		{"redis address", "", nil, []string{"--rate-limit-store", "redis", "--rate-limit-redis-address", "redis"}, []string{`rate_limit.redis.address "redis" is not a host:port address`}},
+		{"default limit", "", nil, []string{"--rate-limit-rps", "-1"}, []string{"rate_limit.default.requests_per_second must not be negative"}},
+		{"route limit", "rate_limit:\n  routes:\n    /racing.Racing/ListRaces:\n      requests_per_second: 1\n", nil, nil, []string{`rate_limit.routes["/racing.Racing/ListRaces"].burst must be at least 1`}},
+		{"cache max age", "", nil, []string{"--cache-max-age", "-1s"}, []string{"cache.max_age must not be negative"}},
+		{"every problem", "", map[string]string{"API_LOG_FORMAT": "xml"}, []string{"--shutdown-timeout", "0s", "--log-level", "loud"}, []string{"shutdown_timeout must be positive", `log_level "loud"`, `log_format "xml"`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := map[string]string{}
+			for name, value := range tc.env {
+				env[name] = value
+			}
+			if tc.file != "" {
+				env["API_CONFIG"] = writeFile(t, "api.yaml", tc.file)
+			}
+			setEnv(t, env)
+
+			cfg, err := config.Load(tc.args)
+			if err == nil {
+				t.Fatalf("Load = %+v, want an error", cfg)
+			}
+
+			for _, want := range tc.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load error = %q, want it to hold %q", err, want)
+				}
+			}
+		})
+	}
+}
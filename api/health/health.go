@@ -0,0 +1,106 @@
+// Package health serves the API gateway's liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Backend is a gRPC service the gateway proxies requests to.
+type Backend struct {
+	// Name identifies the service in readiness reports, e.g. "racing".
+	Name string
+	// Conn is the connection requests to the service are proxied over.
+	Conn *grpc.ClientConn
+}
+
+// report is the body of a probe's response.
+type report struct {
+	Status   string            `json:"status"`
+	Backends map[string]string `json:"backends,omitempty"`
+}
+
+// Liveness reports the gateway is up. It doesn't depend on the backends, so
+// their outages don't get the gateway restarted.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, report{Status: "ok"})
+	})
+}
+
+// Readiness reports whether every backend is serving, checking each with the
+// grpc.health.v1 service over the connection requests are proxied over. The
+// backends are checked concurrently, each within the timeout.
+func Readiness(timeout time.Duration, backends ...Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		var (
+			mu       sync.Mutex
+			wg       sync.WaitGroup
+			statuses = make(map[string]string, len(backends))
+			ready    = true
+		)
+
+		for _, backend := range backends {
+			wg.Add(1)
+
+			go func(backend Backend) {
+				defer wg.Done()
+
+				status, err := check(ctx, backend.Conn)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					log.Warnf("%s health check failed: %s", backend.Name, err)
+					statuses[backend.Name] = "UNKNOWN"
+					ready = false
+
+					return
+				}
+
+				statuses[backend.Name] = status.String()
+				ready = ready && status == healthpb.HealthCheckResponse_SERVING
+			}(backend)
+		}
+
+		wg.Wait()
+
+		if !ready {
+			writeReport(w, http.StatusServiceUnavailable, report{Status: "unavailable", Backends: statuses})
+			return
+		}
+
+		writeReport(w, http.StatusOK, report{Status: "ok", Backends: statuses})
+	})
+}
+
+// check returns the serving status of the server at the end of conn.
+func check(ctx context.Context, conn *grpc.ClientConn) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+
+	return resp.Status, nil
+}
+
+func writeReport(w http.ResponseWriter, code int, r report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		log.Debugf("failed writing health report: %s", err)
+	}
+}
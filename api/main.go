@@ -2,44 +2,244 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"net/http"
+	"os"
+	"time"
 
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/certs"
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/api/health"
+	"git.neds.sh/matty/entain/api/middleware"
 	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/api/proto/sports"
+	"git.neds.sh/matty/entain/api/ratelimit"
+	"git.neds.sh/matty/entain/api/sse"
+	"git.neds.sh/matty/entain/shared/lifecycle"
+	"git.neds.sh/matty/entain/shared/tracing"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 )
 
-var (
-	apiEndpoint  = flag.String("api-endpoint", "localhost:8000", "API endpoint")
-	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
-)
-
 func main() {
-	flag.Parse()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed loading config: %s", err)
+	}
+
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	log.SetLevel(level)
 
-	if err := run(); err != nil {
-		log.Printf("failed running api server: %s\n", err)
+	if cfg.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if err := run(cfg); err != nil {
+		log.Fatalf("failed running api server: %s", err)
 	}
 }
 
-func run() error {
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+func run(cfg *config.Config) error {
+	// The upstream connections outlive the signal, so in-flight requests can
+	// still be served while draining.
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mux := runtime.NewServeMux()
-	if err := racing.RegisterRacingHandlerFromEndpoint(
-		ctx,
-		mux,
-		*grpcEndpoint,
-		[]grpc.DialOption{grpc.WithInsecure()},
-	); err != nil {
+	sigCtx, stop := lifecycle.ShutdownContext(ctx)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, tracing.Config(cfg.Tracing), "api")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("failed flushing trace spans: %s", err)
+		}
+	}()
+
+	racingSecurity, err := racingTransport(cfg.UpstreamTLS)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := certs.ServerConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	authenticators, err := newAuthenticators(cfg.Auth)
+	if err != nil {
+		return err
+	}
+
+	limiter, err := ratelimit.New(cfg.RateLimit)
+	if err != nil {
+		return err
+	}
+	defer limiter.Close()
+
+	if cfg.AdminEndpoint != "" {
+		adminServer, err := lifecycle.ServeAdmin(cfg.AdminEndpoint, promhttp.Handler())
+		if err != nil {
+			return err
+		}
+		defer adminServer.Close()
+	}
+
+	caching := middleware.NewCaching(cfg.Cache.MaxAge)
+
+	mux := runtime.NewServeMux(
+		// Streaming endpoints, such as /v1/watch-races, are delivered as
+		// server-sent events to clients that accept them.
+		runtime.WithMarshalerOption(sse.ContentType, sse.NewMarshaler()),
+		runtime.WithMetadata(middleware.RecordRoute),
+		runtime.WithMetadata(auth.Metadata),
+		runtime.WithIncomingHeaderMatcher(middleware.IncomingHeaderMatcher),
+		runtime.WithForwardResponseOption(caching.ForwardResponse),
+	)
+
+	// The connections are dialled here, rather than by the handlers, so the
+	// readiness probe can check the services' health over them.
+	// Calls to the services continue the trace of the request they're made
+	// for, propagating its context in their metadata, and are rate limited
+	// per client before they reach the services.
+	callOpts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), limiter.Unary()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), limiter.Stream()),
+	}
+
+	racingConn, err := grpc.DialContext(ctx, cfg.GRPCEndpoint, append(callOpts, racingSecurity)...)
+	if err != nil {
+		return err
+	}
+	defer racingConn.Close()
+
+	// The sports service only serves plaintext.
+	sportsConn, err := grpc.DialContext(ctx, cfg.SportsGRPCEndpoint, append(callOpts, grpc.WithInsecure())...)
+	if err != nil {
 		return err
 	}
+	defer sportsConn.Close()
 
-	log.Printf("API server listening on: %s\n", *apiEndpoint)
+	if err := racing.RegisterRacingHandler(ctx, mux, racingConn); err != nil {
+		return err
+	}
+	if err := sports.RegisterSportsHandler(ctx, mux, sportsConn); err != nil {
+		return err
+	}
+
+	// Requests are traced outermost, so their spans cover the whole request,
+	// and their logs can name the trace. Callers are authenticated within
+	// logging and metrics, so refused requests are recorded too, as are
+	// requests answered with 304 Not Modified.
+	gateway := middleware.Trace(middleware.RequestID(middleware.Log(
+		middleware.NewMetrics(prometheus.DefaultRegisterer).Handler(
+			middleware.Authenticate(limiter.Handler(caching.Handler(mux)), authenticators...),
+		),
+	)))
+
+	// Watches would otherwise hold up draining until the shutdown timeout,
+	// so they're ended as soon as shutdown begins.
+	handler := http.NewServeMux()
+	handler.Handle("/", gateway)
+	handler.Handle("/v1/watch-races", middleware.Drain(sigCtx, gateway))
+	handler.Handle("/healthz", health.Liveness())
+	handler.Handle("/readyz", health.Readiness(
+		cfg.ReadinessTimeout,
+		health.Backend{Name: "racing", Conn: racingConn},
+		health.Backend{Name: "sports", Conn: sportsConn},
+	))
+
+	server := &http.Server{
+		Addr:              cfg.APIEndpoint,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	log.Infof("API server listening on: %s", cfg.APIEndpoint)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		// The certificate is served from the TLS config, so it's reloaded
+		// when its files change.
+		if tlsConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-sigCtx.Done():
+	}
+
+	log.Infof("shutting down, draining connections for up to %s", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("connections not drained within %s: %w", cfg.ShutdownTimeout, err)
+	}
+
+	return nil
+}
+
+// newAuthenticators returns the configured means of authenticating callers.
+func newAuthenticators(cfg config.Auth) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+
+	if cfg.JWKSFile != "" {
+		jwt, err := auth.LoadJWT(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, jwt)
+	}
+
+	if cfg.APIKeysFile != "" {
+		apiKeys, err := auth.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	return authenticators, nil
+}
+
+// racingTransport returns the option securing the connection to the racing
+// service: TLS, or mutual TLS, when configured, and plaintext otherwise.
+func racingTransport(cfg config.UpstreamTLS) (grpc.DialOption, error) {
+	creds, err := certs.UpstreamCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if creds == nil {
+		return grpc.WithInsecure(), nil
+	}
 
-	return http.ListenAndServe(*apiEndpoint, mux)
+	return grpc.WithTransportCredentials(creds), nil
 }
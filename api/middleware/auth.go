@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/shared/principal"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// Authenticate identifies the caller of each request to next, by the first
+// of the authenticators to find credentials of its kind in the request.
+// Requests without credentials are passed on anonymously, while those with
+// invalid credentials are refused.
+func Authenticate(next http.Handler, authenticators ...auth.Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range authenticators {
+			p, err := a.Authenticate(r)
+			if err != nil {
+				writeUnauthenticated(w, err)
+				return
+			}
+
+			if p != nil {
+				next.ServeHTTP(w, r.WithContext(principal.NewContext(r.Context(), p)))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeUnauthenticated refuses a request, in the same form as the gateway's
+// errors.
+func writeUnauthenticated(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	body := struct {
+		Code    codes.Code    `json:"code"`
+		Message string        `json:"message"`
+		Details []interface{} `json:"details"`
+	}{codes.Unauthenticated, err.Error(), []interface{}{}}
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("failed writing unauthenticated response: %s", err)
+	}
+}
@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/shared/principal"
+	"google.golang.org/protobuf/proto"
+)
+
+// cacheableKey is the context key marking a request whose response may be
+// cached.
+type cacheableKey struct{}
+
+// Caching lets clients cache race lists and races, revalidating them by
+// their ETag. Responses are cached until the next race in them is advertised
+// to start, when its status changes, and no longer than a maximum age.
+type Caching struct {
+	maxAge time.Duration
+	clock  func() time.Time
+}
+
+// CachingOption configures caching.
+type CachingOption func(*Caching)
+
+// WithCachingClock overrides the clock responses' ages are measured by.
+func WithCachingClock(clock func() time.Time) CachingOption {
+	return func(c *Caching) {
+		c.clock = clock
+	}
+}
+
+// NewCaching creates caching for responses of at most maxAge.
+func NewCaching(maxAge time.Duration, opts ...CachingOption) *Caching {
+	c := &Caching{maxAge: maxAge, clock: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Handler answers GET requests to next whose If-None-Match header holds the
+// ETag of the response with 304 Not Modified, rather than the response.
+// ETags are only set when the gateway mux has been created with
+// ForwardResponse.
+func (c *Caching) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &conditionalWriter{ResponseWriter: w, ifNoneMatch: r.Header.Get("If-None-Match")}
+
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), cacheableKey{}, true)))
+	})
+}
+
+// ForwardResponse sets the ETag and Cache-Control headers of race list and
+// race responses to GET requests served through Handler. It's installed on
+// the gateway mux with runtime.WithForwardResponseOption.
+func (c *Caching) ForwardResponse(ctx context.Context, w http.ResponseWriter, m proto.Message) error {
+	if cacheable, _ := ctx.Value(cacheableKey{}).(bool); !cacheable {
+		return nil
+	}
+
+	var races []*racing.Race
+
+	switch m := m.(type) {
+	case *racing.ListRacesResponse:
+		races = m.Races
+	case *racing.Race:
+		races = []*racing.Race{m}
+	default:
+		return nil
+	}
+
+	tag, err := etag(m, w.Header().Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", tag)
+	w.Header().Add("Vary", "Accept, Authorization, "+auth.APIKeyHeader)
+
+	// Responses differ by caller, as only some may see hidden races, so
+	// only those of anonymous callers may be shared.
+	visibility := "public"
+	if _, ok := principal.FromContext(ctx); ok {
+		visibility = "private"
+	}
+
+	if maxAge := c.responseMaxAge(races); maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, maxAge))
+	} else {
+		w.Header().Set("Cache-Control", visibility+", no-cache")
+	}
+
+	return nil
+}
+
+// responseMaxAge is how many whole seconds a response holding the races may
+// be cached for: until the first of them to start does, and its status
+// changes, but no longer than the maximum age.
+func (c *Caching) responseMaxAge(races []*racing.Race) int {
+	now := c.clock()
+	maxAge := c.maxAge
+
+	for _, race := range races {
+		if untilStart := race.AdvertisedStartTime.AsTime().Sub(now); untilStart > 0 && untilStart < maxAge {
+			maxAge = untilStart
+		}
+	}
+
+	return int(maxAge / time.Second)
+}
+
+// etag derives a strong ETag from the whole of a response's message, and its
+// content type. Deriving it from race IDs and versions alone isn't enough, as
+// a race that's deleted can have its ID reused by a new race, at version 1.
+func etag(m proto.Message, contentType string) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\n%s\n", proto.MessageName(m), contentType)
+	h.Write(b)
+
+	return strconv.Quote(base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18])), nil
+}
+
+// etagMatches reports whether an If-None-Match header holds the ETag. ETags
+// are compared weakly, as RFC 7232 has If-None-Match do.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// conditionalWriter replaces a successful response with 304 Not Modified
+// when its ETag matches the request's If-None-Match header, discarding its
+// body.
+type conditionalWriter struct {
+	http.ResponseWriter
+	ifNoneMatch string
+	wroteHeader bool
+	notModified bool
+}
+
+func (w *conditionalWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	etag := w.Header().Get("ETag")
+
+	if status == http.StatusOK && w.ifNoneMatch != "" && etag != "" && etagMatches(w.ifNoneMatch, etag) {
+		w.notModified = true
+		status = http.StatusNotModified
+
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *conditionalWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.notModified {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *conditionalWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,264 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/api/middleware"
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+var now = time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)
+
+// racingServer serves its race, or list of races, whatever's asked for, or
+// fails with its error.
+type racingServer struct {
+	racing.UnimplementedRacingServer
+	race *racing.Race
+	list *racing.ListRacesResponse
+	err  error
+}
+
+func (s *racingServer) ListRaces(context.Context, *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
+	return s.list, s.err
+}
+
+func (s *racingServer) GetRace(context.Context, *racing.GetRaceRequest) (*racing.Race, error) {
+	return s.race, s.err
+}
+
+// serve serves a request with the server through the gateway, with caching
+// of responses of at most maxAge.
+func serve(t *testing.T, maxAge time.Duration, srv *racingServer, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	caching := middleware.NewCaching(maxAge, middleware.WithCachingClock(func() time.Time { return now }))
+
+	mux := runtime.NewServeMux(runtime.WithForwardResponseOption(caching.ForwardResponse))
+	if err := racing.RegisterRacingHandlerServer(context.Background(), mux, srv); err != nil {
+		t.Fatalf("RegisterRacingHandlerServer: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	caching.Handler(mux).ServeHTTP(rec, r)
+
+	return rec
+}
+
+func startingIn(d time.Duration) *racing.Race {
+	return &racing.Race{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(d))}
+}
+
+func newRace() *racing.Race {
+	return &racing.Race{
+		Id:                  1,
+		MeetingId:           2,
+		Name:                "Alpha",
+		Number:              3,
+		Visible:             true,
+		AdvertisedStartTime: timestamppb.New(now.Add(time.Hour)),
+		Status:              racing.Race_OPEN,
+		Version:             4,
+		LastModified:        timestamppb.New(now.Add(-time.Hour)),
+	}
+}
+
+func TestCachingETag(t *testing.T) {
+	etag := func(srv *racingServer, target string) string {
+		t.Helper()
+
+		rec := serve(t, time.Minute, srv, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("ETag") == "" {
+			t.Fatalf("GET %s = %d with ETag %q, want 200 with an ETag", target, rec.Code, rec.Header().Get("ETag"))
+		}
+
+		return rec.Header().Get("ETag")
+	}
+
+	// Changing any field of a race changes its ETag, by field name.
+	changes := map[string]func(*racing.Race){
+		"id":                    func(r *racing.Race) { r.Id = 5 },
+		"meeting_id":            func(r *racing.Race) { r.MeetingId = 5 },
+		"name":                  func(r *racing.Race) { r.Name = "Bravo" },
+		"number":                func(r *racing.Race) { r.Number = 5 },
+		"visible":               func(r *racing.Race) { r.Visible = false },
+		"advertised_start_time": func(r *racing.Race) { r.AdvertisedStartTime = timestamppb.New(now.Add(2 * time.Hour)) },
+		"status":                func(r *racing.Race) { r.Status = racing.Race_CLOSED },
+		"version":               func(r *racing.Race) { r.Version = 5 },
+		"last_modified":         func(r *racing.Race) { r.LastModified = timestamppb.New(now) },
+	}
+
+	fields := newRace().ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if _, ok := changes[string(fields.Get(i).Name())]; !ok {
+			t.Errorf("race field %s isn't changed by the test", fields.Get(i).Name())
+		}
+	}
+
+	race := etag(&racingServer{race: newRace()}, "/v1/races/1")
+
+	if again := etag(&racingServer{race: newRace()}, "/v1/races/1"); again != race {
+		t.Errorf("ETag of the same race = %s, then %s, want them the same", race, again)
+	}
+
+	for field, change := range changes {
+		changed := newRace()
+		change(changed)
+
+		if got := etag(&racingServer{race: changed}, "/v1/races/1"); got == race {
+			t.Errorf("ETag of the race with %s changed = %s, want it changed", field, got)
+		}
+	}
+
+	// Lists' ETags change with their races and page token too.
+	other := newRace()
+	other.Id = 6
+
+	list := etag(&racingServer{list: &racing.ListRacesResponse{Races: []*racing.Race{newRace(), other}}}, "/v1/races")
+
+	for _, tc := range []struct {
+		name string
+		list *racing.ListRacesResponse
+	}{
+		{"race changed", &racing.ListRacesResponse{Races: []*racing.Race{startingIn(time.Hour), other}}},
+		{"race added", &racing.ListRacesResponse{Races: []*racing.Race{newRace(), other, startingIn(time.Hour)}}},
+		{"race removed", &racing.ListRacesResponse{Races: []*racing.Race{newRace()}}},
+		{"races reordered", &racing.ListRacesResponse{Races: []*racing.Race{other, newRace()}}},
+		{"next page", &racing.ListRacesResponse{Races: []*racing.Race{newRace(), other}, NextPageToken: "next"}},
+	} {
+		if got := etag(&racingServer{list: tc.list}, "/v1/races"); got == list {
+			t.Errorf("ETag of the list with %s = %s, want it changed", tc.name, got)
+		}
+	}
+}
+
+func TestCachingIfNoneMatch(t *testing.T) {
+	srv := &racingServer{race: newRace()}
+
+	first := serve(t, time.Minute, srv, httptest.NewRequest(http.MethodGet, "/v1/races/1", nil))
+	etag := first.Header().Get("ETag")
+
+	for _, tc := range []struct {
+		name        string
+		ifNoneMatch string
+		code        int
+	}{
+		{"none", "", http.StatusOK},
+		{"strong", etag, http.StatusNotModified},
+		{"weak", "W/" + etag, http.StatusNotModified},
+		{"list", `"other", ` + etag, http.StatusNotModified},
+		{"list without spaces", `W/"other",` + etag + `,"another"`, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"other", `"other"`, http.StatusOK},
+		{"other weak", `W/"other"`, http.StatusOK},
+		{"other list", `"other", W/"another"`, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/races/1", nil)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+
+			rec := serve(t, time.Minute, srv, r)
+
+			if rec.Code != tc.code {
+				t.Fatalf("code = %d, want %d", rec.Code, tc.code)
+			}
+
+			// Validators and caching are sent either way, so clients can
+			// carry on caching the response they hold.
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+				t.Errorf("Cache-Control = %q, want %q", got, "public, max-age=60")
+			}
+
+			if tc.code == http.StatusNotModified {
+				if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+					t.Errorf("304 has Content-Type %q and body %q, want neither", rec.Header().Get("Content-Type"), rec.Body)
+				}
+			} else if rec.Body.String() != first.Body.String() {
+				t.Errorf("body = %q, want %q", rec.Body, first.Body)
+			}
+		})
+	}
+}
+
+func TestCachingMaxAge(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		maxAge time.Duration
+		races  []*racing.Race
+		// principal is set for authenticated requests.
+		principal    *principal.Principal
+		cacheControl string
+	}{
+		{"no races", time.Minute, nil, nil, "public, max-age=60"},
+		{"race starting after the max age", time.Minute, []*racing.Race{startingIn(time.Hour)}, nil, "public, max-age=60"},
+		{"race starting within the max age", time.Minute, []*racing.Race{startingIn(30 * time.Second)}, nil, "public, max-age=30"},
+		{"race starting within part of a second", time.Minute, []*racing.Race{startingIn(30*time.Second + 500*time.Millisecond)}, nil, "public, max-age=30"},
+		{"race starting within a second", time.Minute, []*racing.Race{startingIn(500 * time.Millisecond)}, nil, "public, no-cache"},
+		{"race started", time.Minute, []*racing.Race{startingIn(-time.Minute)}, nil, "public, max-age=60"},
+		{"first of many races to start", time.Minute, []*racing.Race{startingIn(time.Hour), startingIn(-10 * time.Second), startingIn(20 * time.Second), startingIn(40 * time.Second)}, nil, "public, max-age=20"},
+		{"no max age", 0, []*racing.Race{startingIn(time.Hour)}, nil, "public, no-cache"},
+		{"authenticated", time.Minute, []*racing.Race{startingIn(30 * time.Second)}, &principal.Principal{Subject: "alice", Method: "jwt"}, "private, max-age=30"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/races", nil)
+			if tc.principal != nil {
+				r = r.WithContext(principal.NewContext(r.Context(), tc.principal))
+			}
+
+			rec := serve(t, tc.maxAge, &racingServer{list: &racing.ListRacesResponse{Races: tc.races}}, r)
+
+			if got := rec.Header().Get("Cache-Control"); got != tc.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tc.cacheControl)
+			}
+		})
+	}
+}
+
+func TestCachingUncacheable(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		srv    *racingServer
+		code   int
+	}{
+		{"race not found", http.MethodGet, "/v1/races/1", &racingServer{err: status.Error(codes.NotFound, "race not found")}, http.StatusNotFound},
+		{"list failed", http.MethodGet, "/v1/races", &racingServer{err: status.Error(codes.Internal, "failed")}, http.StatusInternalServerError},
+		{"list refused", http.MethodGet, "/v1/races", &racingServer{err: status.Error(codes.ResourceExhausted, "rate limit exceeded")}, http.StatusTooManyRequests},
+		{"list by POST", http.MethodPost, "/v1/list-races", &racingServer{list: &racing.ListRacesResponse{Races: []*racing.Race{newRace()}}}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader("{}"))
+			// Errors aren't answered with 304 Not Modified, whatever the
+			// client holds.
+			r.Header.Set("If-None-Match", "*")
+
+			rec := serve(t, time.Minute, tc.srv, r)
+
+			if rec.Code != tc.code || rec.Body.Len() == 0 {
+				t.Fatalf("code = %d with body %q, want %d with a body", rec.Code, rec.Body, tc.code)
+			}
+
+			for _, header := range []string{"ETag", "Cache-Control", "Vary"} {
+				if got := rec.Header().Get(header); got != "" {
+					t.Errorf("%s = %q, want none", header, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+// Package middleware provides the HTTP middleware the API gateway is run
+// with.
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// Drain ends requests to next once ctx is done, so long-lived requests, such
+// as race watches, don't hold up a graceful shutdown.
+func Drain(ctx context.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
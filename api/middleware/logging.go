@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log logs every request to next once it completes, with its request ID when
+// it's been served through RequestID.
+func Log(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		fields := log.Fields{
+			"http.method": r.Method,
+			"http.path":   r.URL.Path,
+			"http.status": rec.status,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"request_id":  RequestIDFromContext(r.Context()),
+		}
+
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+
+		level := log.InfoLevel
+		if rec.status >= http.StatusInternalServerError {
+			level = log.ErrorLevel
+		}
+
+		log.WithFields(fields).Log(level, "finished request")
+	})
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// unmatchedRoute labels requests the gateway didn't route to an RPC.
+const unmatchedRoute = "none"
+
+// routeKey is the context key of the route recorded for a request.
+type routeKey struct{}
+
+// Metrics records the number, status and latency of the gateway's requests,
+// per route. Routes are named after the RPC the gateway forwards them to, so
+// request paths holding IDs don't each get their own series.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the gateway's metrics, registering them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests completed, by route and status code.",
+		}, []string{"method", "route", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to complete HTTP requests, in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+
+	reg.MustRegister(m.requests, m.duration)
+
+	return m
+}
+
+// Handler records the metrics of requests to next. Their routes are only
+// known when the gateway mux has been created with RecordRoute.
+func (m *Metrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := unmatchedRoute
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		m.duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// RecordRoute records the RPC a request is forwarded to as its route, for
+// Metrics, and names the request's trace span after it. It's installed on the
+// gateway mux with runtime.WithMetadata, and adds no metadata of its own.
+func RecordRoute(ctx context.Context, r *http.Request) metadata.MD {
+	method, ok := runtime.RPCMethod(ctx)
+	if !ok {
+		return nil
+	}
+
+	trace.SpanFromContext(ctx).SetName(method)
+
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*route = method
+	}
+
+	return nil
+}
+
+// statusRecorder captures the status code written to a response. It passes
+// flushes through, so streamed responses aren't buffered.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"git.neds.sh/matty/entain/shared/principal"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+)
+
+// RequestIDHeader carries a request's ID. It's taken from the caller when
+// they send one, and otherwise generated, then returned in the response and
+// forwarded to the services.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDMetadataKey is the metadata key the services receive a request's
+// ID in.
+const requestIDMetadataKey = "x-request-id"
+
+// maxRequestIDLength bounds the length of the IDs accepted from callers, so
+// they can't bloat every log line.
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of a request's ID.
+type requestIDKey struct{}
+
+// RequestID makes sure every request to next has an ID, and returns it in the
+// response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		// The header is (re)set on the request, so it's the ID the gateway
+		// forwards.
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the ID of the request ctx belongs to, or "" if
+// it wasn't served through RequestID.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// IncomingHeaderMatcher forwards a request's ID to the services as metadata,
+// along with the headers the gateway forwards by default. Callers can't send
+// principal metadata themselves, to pose as someone else. It's installed on
+// the gateway mux with runtime.WithIncomingHeaderMatcher.
+func IncomingHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, RequestIDHeader) {
+		return requestIDMetadataKey, true
+	}
+
+	name, ok := runtime.DefaultHeaderMatcher(key)
+	if ok && strings.HasPrefix(strings.ToLower(name), principal.MetadataPrefix) {
+		return "", false
+	}
+
+	return name, ok
+}
+
+// validRequestID reports whether a caller's request ID is short and made up
+// of printable ASCII, so it's safe to log and forward.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	// The ID only needs to be unique, so a failure to read randomness, which
+	// leaves zeroes, isn't worth failing the request over.
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full buckets are dropped from a memory store.
+const sweepInterval = time.Minute
+
+// MemoryStore holds buckets in memory, for a single gateway.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	clock     func() time.Time
+}
+
+// MemoryStoreOption configures a memory store.
+type MemoryStoreOption func(*MemoryStore)
+
+// WithClock overrides the clock buckets are refilled by.
+func WithClock(clock func() time.Time) MemoryStoreOption {
+	return func(s *MemoryStore) {
+		s.clock = clock
+	}
+}
+
+// bucket is a token bucket, as of when it was last taken from.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is full again.
+	full time.Time
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore(opts ...MemoryStoreOption) *MemoryStore {
+	s := &MemoryStore{buckets: make(map[string]*bucket), clock: time.Now}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.lastSweep = s.clock()
+
+	return s
+}
+
+// Take takes a token from the bucket of key.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	now := s.clock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	res := limit.result(allowed, b.tokens)
+	b.full = now.Add(res.Reset)
+
+	return res, nil
+}
+
+// sweep drops the buckets that have refilled, as they're no different to new
+// ones, so clients that have gone away don't hold memory forever.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastSweep = now
+}
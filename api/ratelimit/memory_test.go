@@ -0,0 +1,85 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/api/ratelimit"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 2, Burst: 3}
+
+	// take is a token taken after the given time since the last.
+	type take struct {
+		after time.Duration
+		want  ratelimit.Result
+	}
+
+	for _, tc := range []struct {
+		name  string
+		takes []take
+	}{
+		{"burst, then refused", []take{
+			{0, ratelimit.Result{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 1, Reset: time.Second}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 1500 * time.Millisecond}},
+		}},
+		{"refilled at the rate", []take{
+			{0, ratelimit.Result{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 1, Reset: time.Second}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+			{250 * time.Millisecond, ratelimit.Result{Allowed: false, Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 1250 * time.Millisecond}},
+			{250 * time.Millisecond, ratelimit.Result{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+			{time.Second, ratelimit.Result{Allowed: true, Remaining: 1, Reset: time.Second}},
+		}},
+		{"refilled no further than the burst", []take{
+			{0, ratelimit.Result{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+			{time.Hour, ratelimit.Result{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 1, Reset: time.Second}},
+		}},
+		{"refused takes take nothing", []take{
+			{0, ratelimit.Result{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 1, Reset: time.Second}},
+			{0, ratelimit.Result{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 1500 * time.Millisecond}},
+			{0, ratelimit.Result{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 1500 * time.Millisecond}},
+			{500 * time.Millisecond, ratelimit.Result{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)
+			store := ratelimit.NewMemoryStore(ratelimit.WithClock(func() time.Time { return now }))
+
+			for i, take := range tc.takes {
+				now = now.Add(take.after)
+
+				got, err := store.Take(context.Background(), "client", limit)
+				if err != nil {
+					t.Fatalf("Take %d: %v", i, err)
+				}
+
+				if got != take.want {
+					t.Errorf("Take %d = %+v, want %+v", i, got, take.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreTakeByKey(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Limit{Rate: 1, Burst: 1}
+
+	for _, key := range []string{"alice", "bob"} {
+		if res, err := store.Take(context.Background(), key, limit); err != nil || !res.Allowed {
+			t.Errorf("Take(%q) = %+v, %v, want it allowed", key, res, err)
+		}
+	}
+
+	if res, err := store.Take(context.Background(), "alice", limit); err != nil || res.Allowed {
+		t.Errorf("Take(%q) again = %+v, %v, want it refused", "alice", res, err)
+	}
+}
@@ -0,0 +1,240 @@
+// Package ratelimit limits how often each client may call each of the
+// gateway's routes, by token buckets.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/shared/principal"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limit is the rate limit of a route: a bucket of Burst tokens, refilled at
+// Rate tokens per second, with each request taking one.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	// Allowed reports whether a token was taken.
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long until a token can be taken, when none was.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store holds clients' token buckets.
+type Store interface {
+	// Take takes a token from the bucket of key, if it has one, creating the
+	// bucket full when there's none. Buckets may be shared by many gateways,
+	// so taking a token must be atomic.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// result describes a bucket left holding tokens.
+func (l Limit) result(allowed bool, tokens float64) Result {
+	r := Result{
+		Allowed:   allowed,
+		Remaining: int(tokens),
+		Reset:     l.refillTime(float64(l.Burst) - tokens),
+	}
+
+	if !allowed {
+		r.RetryAfter = l.refillTime(1 - tokens)
+	}
+
+	return r
+}
+
+// refillTime is how long the given number of tokens takes to refill.
+func (l Limit) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// requestKey is the context key of the request a call is made for.
+type requestKey struct{}
+
+// request is the client of a gateway request, and the headers of its
+// response, for the limits of calls made for it to be reported in.
+type request struct {
+	client string
+	header http.Header
+}
+
+// Limiter limits the calls the gateway makes to the services for each
+// client, per route. Routes are named after the RPC they're forwarded to.
+type Limiter struct {
+	store          Store
+	closer         func() error
+	defaultLimit   Limit
+	routes         map[string]Limit
+	clientIPHeader string
+	failClosed     bool
+}
+
+// New creates a limiter storing its buckets as configured. It limits nothing
+// when the store is none.
+func New(cfg config.RateLimit) (*Limiter, error) {
+	l := &Limiter{
+		defaultLimit:   newLimit(cfg.Default),
+		routes:         make(map[string]Limit, len(cfg.Routes)),
+		clientIPHeader: cfg.ClientIPHeader,
+		failClosed:     cfg.FailClosed,
+		closer:         func() error { return nil },
+	}
+
+	for route, limit := range cfg.Routes {
+		l.routes[route] = newLimit(limit)
+	}
+
+	switch cfg.Store {
+	case "none":
+	case "memory":
+		l.store = NewMemoryStore()
+	case "redis":
+		store := NewRedisStore(cfg.Redis)
+		l.store, l.closer = store, store.Close
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.Store)
+	}
+
+	return l, nil
+}
+
+func newLimit(cfg config.Limit) Limit {
+	return Limit{Rate: cfg.RequestsPerSecond, Burst: cfg.Burst}
+}
+
+// Close releases the limiter's store.
+func (l *Limiter) Close() error {
+	return l.closer()
+}
+
+// Handler identifies the client of each request to next, for the limits of
+// the calls made for it. Clients are identified by their principal, so it
+// must be served within authentication, or their IP address.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req := &request{client: l.client(r), header: w.Header()}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestKey{}, req)))
+	})
+}
+
+// client identifies the client of a request.
+func (l *Limiter) client(r *http.Request) string {
+	if p, ok := principal.FromContext(r.Context()); ok {
+		return "principal:" + p.Method + ":" + p.Subject
+	}
+
+	if l.clientIPHeader != "" {
+		if ip := r.Header.Get(l.clientIPHeader); ip != "" {
+			return "ip:" + ip
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return "ip:" + ip
+}
+
+// Unary limits unary calls made for gateway requests, failing those over
+// their limit as resource exhausted, which the gateway reports as 429 Too
+// Many Requests.
+func (l *Limiter) Unary() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := l.take(ctx, method); err != nil {
+			return err
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// Stream limits streaming calls made for gateway requests, as Unary does.
+func (l *Limiter) Stream() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := l.take(ctx, method); err != nil {
+			return nil, err
+		}
+
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// take takes a token for a call from its client's bucket for the route,
+// reporting the limit in the response's RateLimit headers. Calls not made for
+// a gateway request, such as health checks, aren't limited. Should the store
+// fail, calls are let through rather than failing every request, unless the
+// limiter fails closed, when they're refused as unavailable.
+func (l *Limiter) take(ctx context.Context, method string) error {
+	req, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return nil
+	}
+
+	limit, ok := l.routes[method]
+	if !ok {
+		limit = l.defaultLimit
+	}
+
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	res, err := l.store.Take(ctx, method+"|"+req.client, limit)
+	if err != nil {
+		if l.failClosed {
+			log.Warnf("failed taking rate limit token, refusing call: %s", err)
+			return status.Error(codes.Unavailable, "rate limit unavailable")
+		}
+
+		log.Warnf("failed taking rate limit token, allowing call: %s", err)
+		return nil
+	}
+
+	req.header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	req.header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	req.header.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+	if !res.Allowed {
+		retryAfter := seconds(res.RetryAfter)
+		req.header.Set("Retry-After", strconv.Itoa(retryAfter))
+
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %ds", retryAfter)
+	}
+
+	return nil
+}
+
+// seconds rounds a duration up to whole seconds, as headers give them.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
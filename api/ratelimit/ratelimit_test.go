@@ -0,0 +1,248 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/api/ratelimit"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+const (
+	listRaces = "/racing.Racing/ListRaces"
+	getRace   = "/racing.Racing/GetRace"
+	listEvent = "/sports.Sports/ListEvents"
+)
+
+// slowly refills buckets so slowly that none refill during a test.
+const slowly = 0.001
+
+func newLimiter(t *testing.T, cfg config.RateLimit) *ratelimit.Limiter {
+	t.Helper()
+
+	if cfg.Store == "" {
+		cfg.Store = "memory"
+	}
+
+	l, err := ratelimit.New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// call makes a call of the method for a gateway request, returning the
+// response's headers and the call's error.
+func call(l *ratelimit.Limiter, r *http.Request, method string) (http.Header, error) {
+	var err error
+
+	rec := httptest.NewRecorder()
+
+	l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err = l.Unary()(r.Context(), method, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return nil
+		})
+	})).ServeHTTP(rec, r)
+
+	return rec.Header(), err
+}
+
+func request(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/races", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestLimiterHeaders(t *testing.T) {
+	l := newLimiter(t, config.RateLimit{Default: config.Limit{RequestsPerSecond: slowly, Burst: 2}})
+
+	for i, want := range []struct {
+		code                         codes.Code
+		remaining, reset, retryAfter string
+	}{
+		{codes.OK, "1", "1000", ""},
+		{codes.OK, "0", "2000", ""},
+		{codes.ResourceExhausted, "0", "2000", "1000"},
+	} {
+		header, err := call(l, request("192.0.2.1:1234"), listRaces)
+
+		if code := status.Code(err); code != want.code {
+			t.Fatalf("call %d = %v, want code %s", i, err, want.code)
+		}
+
+		for name, value := range map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": want.remaining,
+			"RateLimit-Reset":     want.reset,
+			"Retry-After":         want.retryAfter,
+		} {
+			if got := header.Get(name); got != value {
+				t.Errorf("call %d has header %s %q, want %q", i, name, got, value)
+			}
+		}
+	}
+
+	// Calls over the limit are refused by the gateway with 429 Too Many
+	// Requests.
+	if code := runtime.HTTPStatusFromCode(codes.ResourceExhausted); code != http.StatusTooManyRequests {
+		t.Errorf("ResourceExhausted is served as %d, want 429", code)
+	}
+}
+
+func TestLimiterRoutes(t *testing.T) {
+	l := newLimiter(t, config.RateLimit{
+		Default: config.Limit{RequestsPerSecond: slowly, Burst: 1},
+		Routes: map[string]config.Limit{
+			listRaces: {RequestsPerSecond: slowly, Burst: 3},
+			getRace:   {RequestsPerSecond: 0},
+		},
+	})
+
+	for _, tc := range []struct {
+		method string
+		// allowed is how many calls are allowed, or -1 for unlimited.
+		allowed int
+	}{
+		{listRaces, 3},
+		{listEvent, 1},
+		{getRace, -1},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				header, err := call(l, request("192.0.2.1:1234"), tc.method)
+
+				if allowed := tc.allowed < 0 || i < tc.allowed; allowed != (err == nil) {
+					t.Fatalf("call %d = %v, want allowed %t", i, err, allowed)
+				}
+
+				if limited := header.Get("RateLimit-Limit") != ""; limited != (tc.allowed >= 0) {
+					t.Errorf("call %d has RateLimit-Limit %q, want it set %t", i, header.Get("RateLimit-Limit"), tc.allowed >= 0)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterClients(t *testing.T) {
+	as := func(r *http.Request, method, subject string) *http.Request {
+		return r.WithContext(principal.NewContext(r.Context(), &principal.Principal{Subject: subject, Method: method}))
+	}
+
+	withHeader := func(r *http.Request, name, value string) *http.Request {
+		r.Header.Set(name, value)
+		return r
+	}
+
+	for _, tc := range []struct {
+		name           string
+		clientIPHeader string
+		first, second  *http.Request
+		// shared is set when both requests are of the same client.
+		shared bool
+	}{
+		{"principal from different IPs", "", as(request("192.0.2.1:1234"), "jwt", "alice"), as(request("192.0.2.2:1234"), "jwt", "alice"), true},
+		{"different principals from one IP", "", as(request("192.0.2.1:1234"), "jwt", "alice"), as(request("192.0.2.1:1234"), "jwt", "bob"), false},
+		{"API key from different IPs", "", as(request("192.0.2.1:1234"), "api_key", "trading-desk"), as(request("192.0.2.2:1234"), "api_key", "trading-desk"), true},
+		{"API key and token of one subject", "", as(request("192.0.2.1:1234"), "api_key", "alice"), as(request("192.0.2.1:1234"), "jwt", "alice"), false},
+		{"principal and anonymous from one IP", "", as(request("192.0.2.1:1234"), "jwt", "alice"), request("192.0.2.1:1234"), false},
+		{"anonymous from one IP", "", request("192.0.2.1:1234"), request("192.0.2.1:5678"), true},
+		{"anonymous from different IPs", "", request("192.0.2.1:1234"), request("192.0.2.2:1234"), false},
+		{"anonymous from one IPv6 address", "", request("[2001:db8::1]:1234"), request("[2001:db8::1]:5678"), true},
+		{"client IP header", "X-Real-IP", withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.1"), withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.2"), false},
+		{"client IP header of one IP", "X-Real-IP", withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.1"), withHeader(request("10.0.0.2:1234"), "X-Real-IP", "192.0.2.1"), true},
+		{"client IP header missing", "X-Real-IP", request("10.0.0.1:1234"), withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.1"), false},
+		{"client IP header not trusted", "", withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.1"), withHeader(request("10.0.0.1:1234"), "X-Real-IP", "192.0.2.2"), true},
+		{"principal over client IP header", "X-Real-IP", withHeader(as(request("10.0.0.1:1234"), "jwt", "alice"), "X-Real-IP", "192.0.2.1"), withHeader(as(request("10.0.0.1:1234"), "jwt", "alice"), "X-Real-IP", "192.0.2.2"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newLimiter(t, config.RateLimit{
+				Default:        config.Limit{RequestsPerSecond: slowly, Burst: 1},
+				ClientIPHeader: tc.clientIPHeader,
+			})
+
+			if _, err := call(l, tc.first, listRaces); err != nil {
+				t.Fatalf("first call: %v", err)
+			}
+
+			// Only the client's one token was taken by the first call.
+			if _, err := call(l, tc.second, listRaces); (status.Code(err) == codes.ResourceExhausted) != tc.shared {
+				t.Errorf("second call = %v, want refused %t", err, tc.shared)
+			}
+		})
+	}
+}
+
+func TestLimiterUnlimitedCalls(t *testing.T) {
+	l := newLimiter(t, config.RateLimit{Default: config.Limit{RequestsPerSecond: slowly, Burst: 1}})
+
+	// Calls not made for gateway requests, such as health checks, aren't
+	// limited.
+	for i := 0; i < 3; i++ {
+		err := l.Unary()(context.Background(), listRaces, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("call %d outside a request = %v, want it allowed", i, err)
+		}
+	}
+
+	// Nor is anything with the store none.
+	l = newLimiter(t, config.RateLimit{Store: "none", Default: config.Limit{RequestsPerSecond: slowly, Burst: 1}})
+
+	for i := 0; i < 3; i++ {
+		if header, err := call(l, request("192.0.2.1:1234"), listRaces); err != nil || header.Get("RateLimit-Limit") != "" {
+			t.Fatalf("call %d without a store = %v with RateLimit-Limit %q, want it allowed without", i, err, header.Get("RateLimit-Limit"))
+		}
+	}
+}
+
+func TestLimiterStoreFailure(t *testing.T) {
+	// Redis is dialled at an address nothing listens on.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	address := lis.Addr().String()
+	lis.Close()
+
+	for _, tc := range []struct {
+		name       string
+		failClosed bool
+		code       codes.Code
+	}{
+		{"fail open", false, codes.OK},
+		{"fail closed", true, codes.Unavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newLimiter(t, config.RateLimit{
+				Store:      "redis",
+				Default:    config.Limit{RequestsPerSecond: slowly, Burst: 1},
+				FailClosed: tc.failClosed,
+				Redis:      config.Redis{Address: address},
+			})
+
+			for i := 0; i < 3; i++ {
+				header, err := call(l, request("192.0.2.1:1234"), listRaces)
+
+				if code := status.Code(err); code != tc.code {
+					t.Fatalf("call %d = %v, want code %s", i, err, tc.code)
+				}
+
+				if limit := header.Get("RateLimit-Limit"); limit != "" {
+					t.Errorf("call %d has RateLimit-Limit %q, want none, as the limit isn't known", i, limit)
+				}
+			}
+		})
+	}
+}
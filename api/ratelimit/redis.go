@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"git.neds.sh/matty/entain/api/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisTimeout bounds each command sent to Redis, so a slow server delays
+// requests by no more than it.
+const redisTimeout = 100 * time.Millisecond
+
+// takeScript takes a token from the bucket of KEYS[1], given its rate
+// (ARGV[1]), burst (ARGV[2]) and the time in milliseconds (ARGV[3]). It
+// returns whether a token was taken, and the tokens left. Buckets expire once
+// they'd be full again, as they're no different to new ones.
+var takeScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore holds buckets in a Redis-compatible server, shared by every
+// gateway using it.
+type RedisStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisStore creates a store in the configured server. Connections are
+// made as they're needed.
+func NewRedisStore(cfg config.Redis) *RedisStore {
+	return &RedisStore{
+		pool: &redis.Pool{
+			DialContext: func(ctx context.Context) (redis.Conn, error) {
+				return redis.DialContext(ctx, "tcp", cfg.Address,
+					redis.DialPassword(cfg.Password),
+					redis.DialDatabase(cfg.DB),
+					redis.DialConnectTimeout(redisTimeout),
+					redis.DialReadTimeout(redisTimeout),
+					redis.DialWriteTimeout(redisTimeout),
+				)
+			},
+			MaxIdle:     16,
+			IdleTimeout: time.Minute,
+		},
+		prefix: cfg.KeyPrefix,
+	}
+}
+
+// Take takes a token from the bucket of key.
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	reply, err := redis.Values(takeScript.Do(conn, s.prefix+key, limit.Rate, limit.Burst, now))
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(reply) != 2 {
+		return Result{}, fmt.Errorf("unexpected reply from rate limit script: %v", reply)
+	}
+
+	allowed, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	remaining, err := redis.String(reply[1], nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return limit.result(allowed == 1, tokens), nil
+}
+
+// Close closes the store's connections.
+func (s *RedisStore) Close() error {
+	return s.pool.Close()
+}
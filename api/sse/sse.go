@@ -0,0 +1,53 @@
+// Package sse provides a grpc-gateway marshaler that frames streamed
+// responses as server-sent events.
+package sse
+
+import (
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ContentType is the MIME type clients accept to receive server-sent events.
+const ContentType = "text/event-stream"
+
+// Marshaler encodes messages as JSON, prefixing each with the SSE "data:"
+// field and delimiting them with a blank line. Registered against
+// ContentType, it lets streaming RPCs be consumed with an EventSource.
+type Marshaler struct {
+	runtime.Marshaler
+}
+
+// NewMarshaler returns a Marshaler encoding JSON the same way the gateway's
+// default marshaler does.
+func NewMarshaler() *Marshaler {
+	return &Marshaler{
+		Marshaler: &runtime.JSONPb{
+			MarshalOptions: protojson.MarshalOptions{
+				EmitUnpopulated: true,
+			},
+			UnmarshalOptions: protojson.UnmarshalOptions{
+				DiscardUnknown: true,
+			},
+		},
+	}
+}
+
+// Marshal encodes v as a single SSE data field.
+func (m *Marshaler) Marshal(v interface{}) ([]byte, error) {
+	b, err := m.Marshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("data: "), b...), nil
+}
+
+// ContentType always reports the SSE content type.
+func (m *Marshaler) ContentType(_ interface{}) string {
+	return ContentType
+}
+
+// Delimiter terminates each event with a blank line.
+func (m *Marshaler) Delimiter() []byte {
+	return []byte("\n\n")
+}
@@ -0,0 +1,88 @@
+// Package auth authorizes calls by the roles of the principal the API
+// gateway authenticated their caller as. The gateway forwards the principal
+// as metadata, which the service trusts, so only the gateway should be able
+// to reach the service, e.g. by mutual TLS.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// Permission is something a role may allow its holders to do.
+type Permission string
+
+const (
+	// ReadHiddenRaces allows seeing races that aren't visible.
+	ReadHiddenRaces Permission = "races:read_hidden"
+	// WriteRaces allows creating, updating and deleting races.
+	WriteRaces Permission = "races:write"
+)
+
+// permissions are the permissions a policy may grant.
+var permissions = map[Permission]bool{
+	ReadHiddenRaces: true,
+	WriteRaces:      true,
+}
+
+// Policy maps roles to the permissions they grant. Anonymous callers, and
+// callers holding none of its roles, have no permissions.
+type Policy struct {
+	roles map[string]map[Permission]bool
+}
+
+// LoadPolicy loads a policy from a YAML file, listing the permissions of each
+// role, e.g.
+//
+//	roles:
+//	  trader: [races:read_hidden, races:write]
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %w", err)
+	}
+
+	var file struct {
+		Roles map[string][]Permission `yaml:"roles"`
+	}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing policy %s: %w", path, err)
+	}
+
+	p := &Policy{roles: make(map[string]map[Permission]bool, len(file.Roles))}
+
+	for role, perms := range file.Roles {
+		p.roles[role] = make(map[Permission]bool, len(perms))
+
+		for _, perm := range perms {
+			if !permissions[perm] {
+				return nil, fmt.Errorf("role %q in policy %s has unknown permission %q", role, path, perm)
+			}
+
+			p.roles[role][perm] = true
+		}
+	}
+
+	return p, nil
+}
+
+// Allows reports whether the caller of ctx holds a role granting perm.
+func (p *Policy) Allows(ctx context.Context, perm Permission) bool {
+	caller, ok := principal.FromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	for _, role := range caller.Roles {
+		if p.roles[role][perm] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+// Package certs provides the racing service's TLS credentials, from the
+// certificates and CAs it's configured with. They're reloaded when their
+// files change, so they can be rotated without a restart.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"git.neds.sh/matty/entain/racing/config"
+	sharedcerts "git.neds.sh/matty/entain/shared/certs"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServerCredentials returns the gRPC server's credentials, or nil when TLS is
+// disabled. When a client CA file is configured, clients must present a
+// certificate it signed.
+func ServerCredentials(cfg config.TLS) (credentials.TransportCredentials, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	keyPair, err := sharedcerts.LoadKeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientCAs *sharedcerts.CAPool
+	if cfg.ClientCAFile != "" {
+		if clientCAs, err = sharedcerts.LoadCAPool(cfg.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &serverCredentials{
+		config: func() *tls.Config {
+			c := &tls.Config{
+				Certificates: []tls.Certificate{*keyPair.Certificate()},
+				MinVersion:   tls.VersionTLS12,
+			}
+
+			if clientCAs != nil {
+				c.ClientCAs = clientCAs.Pool()
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return c
+		},
+	}, nil
+}
+
+// serverCredentials handshakes with the TLS configuration current at the
+// time, so rotated certificates are used by new connections.
+type serverCredentials struct {
+	config func() *tls.Config
+}
+
+func (c *serverCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.config()).ServerHandshake(conn)
+}
+
+func (c *serverCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("certs: server credentials can't be used by clients")
+}
+
+func (c *serverCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2"}
+}
+
+func (c *serverCredentials) Clone() credentials.TransportCredentials {
+	return &serverCredentials{config: c.config}
+}
+
+func (c *serverCredentials) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,355 @@
+// Package config loads the racing service's configuration. Settings are
+// read from a YAML file, then environment variables, then flags, each taking
+// precedence over the last.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variable of every setting. A setting's
+// variable is named after its flag, e.g. RACING_GRPC_ENDPOINT.
+const envPrefix = "RACING_"
+
+// Config is the racing service's configuration.
+type Config struct {
+	// GRPCEndpoint is the address the gRPC server listens on.
+	GRPCEndpoint string `yaml:"grpc_endpoint"`
+	// AdminEndpoint is the address the admin HTTP server, which serves
+	// /metrics, listens on. It's disabled when empty.
+	AdminEndpoint string `yaml:"admin_endpoint"`
+	// RPCTimeout is the server-side deadline of each unary RPC, or zero for
+	// none.
+	RPCTimeout time.Duration `yaml:"rpc_timeout"`
+	// ShutdownTimeout bounds how long in-flight RPCs are given to finish
+	// once the service is asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HealthCheckInterval is how often the database is checked to be
+	// reachable, for the health service.
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	// LogLevel is the minimum level logged, e.g. "info".
+	LogLevel string `yaml:"log_level"`
+	// LogFormat is json, for log aggregation, or text, for reading in a
+	// terminal.
+	LogFormat string `yaml:"log_format"`
+	// PolicyFile maps callers' roles to the permissions they grant.
+	PolicyFile string `yaml:"policy_file"`
+
+	DB      DB      `yaml:"db"`
+	Cache   Cache   `yaml:"cache"`
+	Seed    Seed    `yaml:"seed"`
+	TLS     TLS     `yaml:"tls"`
+	Tracing Tracing `yaml:"tracing"`
+}
+
+// DB configures the database races are stored in.
+type DB struct {
+	// Driver is sqlite3, postgres or memory.
+	Driver string `yaml:"driver"`
+	// DSN is the data source name the database is opened with.
+	DSN string `yaml:"dsn"`
+}
+
+// Cache configures the cache of race lists kept in front of the database.
+// Writes drop the lists they may change straight away.
+type Cache struct {
+	// Size is the most lists cached, or zero to disable the cache.
+	Size int `yaml:"size"`
+	// TTL is the longest a list is cached for.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Seed configures the races the database is seeded with.
+type Seed struct {
+	// Mode is none, demo or fixture.
+	Mode string `yaml:"mode"`
+	// Random is the random seed demo races are generated from.
+	Random int64 `yaml:"random"`
+	// Reference is the RFC3339 time demo races are advertised around, or
+	// empty for the time the service starts.
+	Reference string `yaml:"reference"`
+	// Fixture is the JSON or YAML file fixture races are loaded from.
+	Fixture string `yaml:"fixture"`
+}
+
+// TLS configures the gRPC server's certificate. TLS is disabled when no
+// certificate is given. The files are reloaded when they change.
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile holds the CA certificates clients' certificates are
+	// verified against. When set, clients must present a certificate
+	// (mutual TLS).
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// Tracing configures how trace spans are exported. Its fields must match
+// those of the shared tracing.Config, which it's converted to.
+type Tracing struct {
+	// Exporter is none, otlp, stdout or file.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector spans are sent to over
+	// gRPC, for the otlp exporter.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans to the collector in plaintext.
+	Insecure bool `yaml:"insecure"`
+	// File is the file spans are appended to, for the file exporter.
+	File string `yaml:"file"`
+	// SampleRatio is the fraction of new traces sampled, from 0 to 1. Traces
+	// begun by a caller follow the caller's sampling decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Default returns the configuration used where nothing else is set.
+func Default() Config {
+	return Config{
+		GRPCEndpoint:        "localhost:9000",
+		AdminEndpoint:       "localhost:9090",
+		RPCTimeout:          10 * time.Second,
+		ShutdownTimeout:     15 * time.Second,
+		HealthCheckInterval: 10 * time.Second,
+		LogLevel:            "info",
+		LogFormat:           "json",
+		PolicyFile:          "./policy.yaml",
+		DB: DB{
+			Driver: "sqlite3",
+			DSN:    "./db/racing.db",
+		},
+		Cache: Cache{
+			Size: 1000,
+			TTL:  5 * time.Second,
+		},
+		Seed: Seed{
+			Mode:    "none",
+			Random:  1,
+			Fixture: "./db/fixtures/races.yaml",
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load builds the configuration from the command line arguments, the
+// environment, and the YAML file named by --config or RACING_CONFIG, if any.
+// It returns the remaining, positional arguments alongside it.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("racing", flag.ContinueOnError)
+	file := fs.String("config", "", "YAML configuration file")
+
+	fs.StringVar(&cfg.GRPCEndpoint, "grpc-endpoint", cfg.GRPCEndpoint, "gRPC server endpoint")
+	fs.StringVar(&cfg.AdminEndpoint, "admin-endpoint", cfg.AdminEndpoint, "Admin HTTP server endpoint, serving /metrics (empty to disable)")
+	fs.DurationVar(&cfg.RPCTimeout, "rpc-timeout", cfg.RPCTimeout, "Server-side deadline for each unary RPC (0 to disable)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Time in-flight RPCs are given to finish on shutdown")
+	fs.DurationVar(&cfg.HealthCheckInterval, "health-check-interval", cfg.HealthCheckInterval, "How often the database is checked to be reachable")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Minimum level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: json or text")
+	fs.StringVar(&cfg.PolicyFile, "policy-file", cfg.PolicyFile, "YAML file mapping callers' roles to permissions")
+	fs.StringVar(&cfg.DB.Driver, "db-driver", cfg.DB.Driver, "Database driver races are stored with: sqlite3, postgres or memory")
+	fs.StringVar(&cfg.DB.DSN, "db-dsn", cfg.DB.DSN, "Data source name of the races database")
+	fs.IntVar(&cfg.Cache.Size, "cache-size", cfg.Cache.Size, "Most race lists cached in front of the database (0 to disable)")
+	fs.DurationVar(&cfg.Cache.TTL, "cache-ttl", cfg.Cache.TTL, "Longest a race list is cached for")
+	fs.StringVar(&cfg.Seed.Mode, "seed", cfg.Seed.Mode, "Races to seed the database with: none, demo or fixture")
+	fs.Int64Var(&cfg.Seed.Random, "seed-random", cfg.Seed.Random, "Random seed demo races are generated from")
+	fs.StringVar(&cfg.Seed.Reference, "seed-reference", cfg.Seed.Reference, "RFC3339 time demo races are advertised around (default now)")
+	fs.StringVar(&cfg.Seed.Fixture, "seed-fixture", cfg.Seed.Fixture, "JSON or YAML file fixture races are loaded from")
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert-file", cfg.TLS.CertFile, "TLS certificate file of the gRPC server")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key-file", cfg.TLS.KeyFile, "TLS key file of the gRPC server")
+	fs.StringVar(&cfg.TLS.ClientCAFile, "tls-client-ca-file", cfg.TLS.ClientCAFile, "CA file clients' certificates are verified against, requiring them (mutual TLS)")
+	fs.StringVar(&cfg.Tracing.Exporter, "tracing-exporter", cfg.Tracing.Exporter, "Where trace spans are exported: none, otlp, stdout or file")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "OTLP gRPC collector endpoint, for the otlp exporter")
+	fs.BoolVar(&cfg.Tracing.Insecure, "tracing-insecure", cfg.Tracing.Insecure, "Send spans to the OTLP collector in plaintext")
+	fs.StringVar(&cfg.Tracing.File, "tracing-file", cfg.Tracing.File, "File trace spans are appended to, for the file exporter")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "tracing-sample-ratio", cfg.Tracing.SampleRatio, "Fraction of new traces sampled, from 0 to 1")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Flags are parsed first to find the config file, so note which were set
+	// to re-apply them over the file and environment.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+
+	if *file == "" {
+		*file = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if *file != "" {
+		if err := loadFile(*file, &cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := applyEnv(fs); err != nil {
+		return nil, nil, err
+	}
+
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return &cfg, fs.Args(), nil
+}
+
+// loadFile reads a YAML config file over cfg. Unknown keys are rejected, so
+// typos don't go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv sets each flag from its environment variable, where present.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// Validate checks the configuration is usable, reporting every problem
+// found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if _, _, err := net.SplitHostPort(c.GRPCEndpoint); err != nil {
+		problems = append(problems, fmt.Sprintf("grpc_endpoint %q is not a host:port address", c.GRPCEndpoint))
+	}
+
+	if c.AdminEndpoint != "" {
+		if _, _, err := net.SplitHostPort(c.AdminEndpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("admin_endpoint %q is not a host:port address", c.AdminEndpoint))
+		}
+	}
+
+	if c.RPCTimeout < 0 {
+		problems = append(problems, "rpc_timeout must not be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+
+	if c.HealthCheckInterval <= 0 {
+		problems = append(problems, "health_check_interval must be positive")
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level %q is not a valid level", c.LogLevel))
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		problems = append(problems, fmt.Sprintf("log_format %q is not one of json or text", c.LogFormat))
+	}
+
+	if c.PolicyFile == "" {
+		problems = append(problems, "policy_file is required")
+	}
+
+	switch c.DB.Driver {
+	case "sqlite3", "postgres":
+		if c.DB.DSN == "" {
+			problems = append(problems, fmt.Sprintf("db.dsn is required by driver %q", c.DB.Driver))
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("db.driver %q is not one of sqlite3, postgres or memory", c.DB.Driver))
+	}
+
+	if c.Cache.Size < 0 {
+		problems = append(problems, "cache.size must not be negative")
+	}
+
+	if c.Cache.Size > 0 && c.Cache.TTL <= 0 {
+		problems = append(problems, "cache.ttl must be positive when caching")
+	}
+
+	switch c.Seed.Mode {
+	case "none":
+	case "demo":
+		if c.Seed.Reference != "" {
+			if _, err := time.Parse(time.RFC3339, c.Seed.Reference); err != nil {
+				problems = append(problems, fmt.Sprintf("seed.reference %q is not an RFC3339 time", c.Seed.Reference))
+			}
+		}
+	case "fixture":
+		if c.Seed.Fixture == "" {
+			problems = append(problems, "seed.fixture is required by seed mode \"fixture\"")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("seed.mode %q is not one of none, demo or fixture", c.Seed.Mode))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		problems = append(problems, "tls.client_ca_file requires tls.cert_file")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if _, _, err := net.SplitHostPort(c.Tracing.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("tracing.endpoint %q is not a host:port address", c.Tracing.Endpoint))
+		}
+	case "file":
+		if c.Tracing.File == "" {
+			problems = append(problems, "tracing.file is required by exporter \"file\"")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter %q is not one of none, otlp, stdout or file", c.Tracing.Exporter))
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
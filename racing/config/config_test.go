@@ -0,0 +1,185 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/config"
+)
+
+// setEnv sets the environment for a test, having unset every variable of
+// the service's, and restores it once the test ends.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	saved := os.Environ()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, kv := range saved {
+			kv := strings.SplitN(kv, "=", 2)
+			os.Setenv(kv[0], kv[1])
+		}
+	})
+
+	for _, kv := range saved {
+		if name := strings.SplitN(kv, "=", 2)[0]; strings.HasPrefix(name, "RACING_") {
+			os.Unsetenv(name)
+		}
+	}
+
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+}
+
+// writeFile writes a config file for a test, returning its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, "racing.yaml", `
+log_level: warn
+shutdown_timeout: 30s
+db:
+  driver: postgres
+  dsn: postgres://racing@localhost/racing
+cache:
+  size: 10
+`)
+	other := writeFile(t, "other.yaml", "log_level: error\n")
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		// field is the setting checked, which should be want.
+		field func(*config.Config) interface{}
+		want  interface{}
+	}{
+		{"default", nil, nil, logLevel, "info"},
+		{"file", nil, []string{"--config", file}, logLevel, "warn"},
+		{"file named by the environment", map[string]string{"RACING_CONFIG": file}, nil, logLevel, "warn"},
+		{"file flag over environment", map[string]string{"RACING_CONFIG": other}, []string{"--config", file}, logLevel, "warn"},
+		{"environment", map[string]string{"RACING_LOG_LEVEL": "debug"}, nil, logLevel, "debug"},
+		{"environment over file", map[string]string{"RACING_LOG_LEVEL": "debug"}, []string{"--config", file}, logLevel, "debug"},
+		{"flag", nil, []string{"--log-level", "error"}, logLevel, "error"},
+		{"flag over environment", map[string]string{"RACING_LOG_LEVEL": "debug"}, []string{"--log-level", "error"}, logLevel, "error"},
+		{"flag over file", nil, []string{"--config", file, "--log-level", "error"}, logLevel, "error"},
+		{"flag set to the default over file", nil, []string{"--config", file, "--log-level", "info"}, logLevel, "info"},
+		{"flag before file flag", map[string]string{"RACING_LOG_LEVEL": "debug"}, []string{"--log-level", "error", "--config", file}, logLevel, "error"},
+		{"duration from file", nil, []string{"--config", file}, shutdownTimeout, 30 * time.Second},
+		{"duration from environment", map[string]string{"RACING_SHUTDOWN_TIMEOUT": "1m"}, []string{"--config", file}, shutdownTimeout, time.Minute},
+		{"nested settings from file", nil, []string{"--config", file}, db, config.DB{Driver: "postgres", DSN: "postgres://racing@localhost/racing"}},
+		{"nested setting from environment", map[string]string{"RACING_DB_DRIVER": "sqlite3"}, []string{"--config", file}, db, config.DB{Driver: "sqlite3", DSN: "postgres://racing@localhost/racing"}},
+		{"nested setting from flag", map[string]string{"RACING_DB_DRIVER": "sqlite3"}, []string{"--config", file, "--db-driver", "memory"}, db, config.DB{Driver: "memory", DSN: "postgres://racing@localhost/racing"}},
+		{"default alongside file", nil, []string{"--config", file}, cache, config.Cache{Size: 10, TTL: 5 * time.Second}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnv(t, tc.env)
+
+			cfg, _, err := config.Load(tc.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			if got := tc.field(cfg); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("setting = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func logLevel(c *config.Config) interface{}        { return c.LogLevel }
+func shutdownTimeout(c *config.Config) interface{} { return c.ShutdownTimeout }
+func db(c *config.Config) interface{}              { return c.DB }
+func cache(c *config.Config) interface{}           { return c.Cache }
+
+func TestLoadArgs(t *testing.T) {
+	setEnv(t, nil)
+
+	cfg, args, err := config.Load([]string{"--db-driver", "memory", "migrate", "down", "1"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if want := []string{"migrate", "down", "1"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %q, want %q", args, want)
+	}
+
+	if cfg.DB.Driver != "memory" {
+		t.Errorf("db.driver = %q, want memory", cfg.DB.Driver)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// errs are parts of the error, each of which it should hold.
+		errs []string
+	}{
+		{"missing file", "", nil, []string{"--config", "missing.yaml"}, []string{"reading config file"}},
+		{"unknown file setting", "db:\n  drvier: memory\n", nil, nil, []string{"parsing config file", "drvier"}},
+		{"invalid file setting", "cache:\n  size: many\n", nil, nil, []string{"parsing config file"}},
+		{"invalid environment setting", "", map[string]string{"RACING_CACHE_SIZE": "many"}, nil, []string{`invalid value "many" for RACING_CACHE_SIZE`}},
+		{"invalid flag", "", nil, []string{"--cache-size", "many"}, []string{"cache-size"}},
+		{"endpoint", "", nil, []string{"--grpc-endpoint", "9000"}, []string{`grpc_endpoint "9000" is not a host:port address`}},
+		{"admin endpoint", "", nil, []string{"--admin-endpoint", "9090"}, []string{`admin_endpoint "9090" is not a host:port address`}},
+		{"RPC timeout", "", nil, []string{"--rpc-timeout", "-1s"}, []string{"rpc_timeout must not be negative"}},
+		{"shutdown timeout", "", nil, []string{"--shutdown-timeout", "0s"}, []string{"shutdown_timeout must be positive"}},
+		{"health check interval", "", nil, []string{"--health-check-interval", "0s"}, []string{"health_check_interval must be positive"}},
+		{"log level", "", nil, []string{"--log-level", "loud"}, []string{`log_level "loud" is not a valid level`}},
+		{"log format", "", nil, []string{"--log-format", "xml"}, []string{`log_format "xml" is not one of json or text`}},
+		{"policy file", "", nil, []string{"--policy-file", ""}, []string{"policy_file is required"}},
+		{"database driver", "", nil, []string{"--db-driver", "mysql"}, []string{`db.driver "mysql" is not one of sqlite3, postgres or memory`}},
+		{"database DSN", "", nil, []string{"--db-driver", "postgres", "--db-dsn", ""}, []string{`db.dsn is required by driver "postgres"`}},
+		{"cache size", "", nil, []string{"--cache-size", "-1"}, []string{"cache.size must not be negative"}},
+		{"cache TTL", "", nil, []string{"--cache-ttl", "0s"}, []string{"cache.ttl must be positive when caching"}},
+		{"seed mode", "", nil, []string{"--seed", "all"}, []string{`seed.mode "all" is not one of none, demo or fixture`}},
+		{"seed reference", "", nil, []string{"--seed", "demo", "--seed-reference", "tomorrow"}, []string{`seed.reference "tomorrow" is not an RFC3339 time`}},
+		{"seed fixture", "", nil, []string{"--seed", "fixture", "--seed-fixture", ""}, []string{`seed.fixture is required by seed mode "fixture"`}},
+		{"certificate without key", "", nil, []string{"--tls-cert-file", "racing.pem"}, []string{"tls.cert_file and tls.key_file must be set together"}},
+		{"client CA without certificate", "", nil, []string{"--tls-client-ca-file", "ca.pem"}, []string{"tls.client_ca_file requires tls.cert_file"}},
+		{"tracing exporter", "", nil, []string{"--tracing-exporter", "jaeger"}, []string{`tracing.exporter "jaeger" is not one of none, otlp, stdout or file`}},
+		{"tracing file", "", nil, []string{"--tracing-exporter", "file"}, []string{`tracing.file is required by exporter "file"`}},
+		{"sample ratio", "", nil, []string{"--tracing-sample-ratio", "2"}, []string{"tracing.sample_ratio must be between 0 and 1"}},
+		{"every problem", "", map[string]string{"RACING_LOG_FORMAT": "xml"}, []string{"--shutdown-timeout", "0s", "--log-level", "loud"}, []string{"shutdown_timeout must be positive", `log_level "loud"`, `log_format "xml"`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := map[string]string{}
+			for name, value := range tc.env {
+				env[name] = value
+			}
+			if tc.file != "" {
+				env["RACING_CONFIG"] = writeFile(t, "racing.yaml", tc.file)
+			}
+			setEnv(t, env)
+
+			cfg, _, err := config.Load(tc.args)
+			if err == nil {
+				t.Fatalf("Load = %+v, want an error", cfg)
+			}
+
+			for _, want := range tc.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load error = %q, want it to hold %q", err, want)
+				}
+			}
+		})
+	}
+}
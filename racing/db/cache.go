@@ -0,0 +1,361 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// cachingRacesRepo caches the race lists of another repository. Most calls
+// list the same handful of filters, which it serves from memory rather than
+// querying the database each time.
+type cachingRacesRepo struct {
+	repoOptions
+
+	next RacesRepo
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	// entries indexes the elements of lru, which holds the cached lists,
+	// most recently used first, by their key.
+	entries map[string]*list.Element
+	lru     *list.List
+	// flights holds the lists being fetched from the repository, by their
+	// key and generation, for concurrent lookups of them to share.
+	flights map[string]*flight
+	// generation is incremented by every write, so lists fetched before it
+	// aren't cached, nor shared with lookups made after it.
+	generation uint64
+}
+
+// cacheEntry is a cached page of races.
+type cacheEntry struct {
+	key string
+	// filter is the normalized filter the races were listed by.
+	filter        *racing.ListRacesRequestFilter
+	races         []*racing.Race
+	nextPageToken string
+	expires       time.Time
+}
+
+// flight is a list being fetched from the repository. Its result is set
+// before done is closed.
+type flight struct {
+	done          chan struct{}
+	races         []*racing.Race
+	nextPageToken string
+	err           error
+}
+
+// NewCachingRacesRepo caches the lists of up to size distinct requests to
+// next, evicting the least recently used, for up to ttl. Lists are cached no
+// longer than until a race in them starts, when its status changes, or any
+// race they'd select when filtered by status, and are dropped as soon as a
+// write through the cache may change them, or fails. Writes made
+// any other way, such as by another process sharing the database, aren't seen
+// until the lists expire, so ttl bounds how stale they may be. Concurrent
+// lookups of the same list are served by a single query. The size must be
+// positive. Only the options' clock and metrics apply.
+func NewCachingRacesRepo(next RacesRepo, size int, ttl time.Duration, opts ...RacesRepoOption) RacesRepo {
+	return &cachingRacesRepo{
+		repoOptions: newRepoOptions(opts),
+		next:        next,
+		size:        size,
+		ttl:         ttl,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		flights:     make(map[string]*flight),
+	}
+}
+
+func (c *cachingRacesRepo) Init(ctx context.Context) error {
+	return c.next.Init(ctx)
+}
+
+func (c *cachingRacesRepo) List(ctx context.Context, in *racing.ListRacesRequest) ([]*racing.Race, string, error) {
+	key, err := listKey(in)
+	if err != nil {
+		// Invalid requests are left to the repository to refuse.
+		return c.next.List(ctx, in)
+	}
+
+	now := c.clock()
+
+	c.mu.Lock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			c.lookedUp("hit")
+
+			return cloneRaces(entry.races), entry.nextPageToken, nil
+		}
+
+		c.remove(el)
+	}
+
+	generation := c.generation
+	flightKey := key + "@" + strconv.FormatUint(generation, 10)
+
+	if f, ok := c.flights[flightKey]; ok {
+		c.mu.Unlock()
+		c.lookedUp("shared")
+
+		return c.wait(ctx, f, in)
+	}
+
+	f := &flight{done: make(chan struct{})}
+	c.flights[flightKey] = f
+
+	c.mu.Unlock()
+	c.lookedUp("miss")
+
+	f.races, f.nextPageToken, f.err = c.next.List(ctx, in)
+
+	expires := c.expiry(f.races, now)
+
+	// Lists filtered by status change as any race they'd select starts,
+	// not only those in them: a race starting joins a list of closed races,
+	// and moves races between pages of open ones.
+	var startErr error
+	if f.err == nil && len(in.Filter.GetStatuses()) > 0 {
+		var starting []*racing.Race
+
+		starting, startErr = c.nextToStart(ctx, in.Filter)
+		if startExpires := c.expiry(starting, now); startExpires.Before(expires) {
+			expires = startExpires
+		}
+	}
+
+	c.mu.Lock()
+
+	delete(c.flights, flightKey)
+
+	if f.err == nil && startErr == nil && c.generation == generation {
+		c.store(&cacheEntry{
+			key:           key,
+			filter:        normalizeFilter(in.Filter),
+			races:         cloneRaces(f.races),
+			nextPageToken: f.nextPageToken,
+			expires:       expires,
+		})
+	}
+
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.races, f.nextPageToken, f.err
+}
+
+// wait returns the result of a list being fetched by another lookup. Should
+// that lookup's context end, the list is fetched again for this one.
+func (c *cachingRacesRepo) wait(ctx context.Context, f *flight, in *racing.ListRacesRequest) ([]*racing.Race, string, error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+
+	if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+		return c.next.List(ctx, in)
+	}
+
+	return cloneRaces(f.races), f.nextPageToken, f.err
+}
+
+// expiry returns when a list of races fetched at now expires: after the TTL,
+// or when the first race in it to start does, if that's sooner.
+func (c *cachingRacesRepo) expiry(races []*racing.Race, now time.Time) time.Time {
+	expires := now.Add(c.ttl)
+
+	for _, race := range races {
+		if start := race.AdvertisedStartTime.AsTime(); start.After(now) && start.Before(expires) {
+			expires = start
+		}
+	}
+
+	return expires
+}
+
+// nextToStart returns the next race to start, of those the filter selects
+// whatever their status.
+func (c *cachingRacesRepo) nextToStart(ctx context.Context, filter *racing.ListRacesRequestFilter) ([]*racing.Race, error) {
+	open := proto.Clone(filter).(*racing.ListRacesRequestFilter)
+	open.Statuses = []racing.Race_Status{racing.Race_OPEN}
+
+	races, _, err := c.next.List(ctx, &racing.ListRacesRequest{Filter: open, OrderBy: defaultRacesOrderBy, PageSize: 1})
+
+	return races, err
+}
+
+// store caches an entry, evicting the least recently used entries to make
+// room for it.
+func (c *cachingRacesRepo) store(entry *cacheEntry) {
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+}
+
+// remove drops an entry from the cache.
+func (c *cachingRacesRepo) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+func (c *cachingRacesRepo) Get(ctx context.Context, id int64) (*racing.Race, error) {
+	return c.next.Get(ctx, id)
+}
+
+func (c *cachingRacesRepo) Create(ctx context.Context, race *racing.Race) (*racing.Race, error) {
+	created, err := c.next.Create(ctx, race)
+	if err != nil {
+		c.invalidateAll()
+		return nil, err
+	}
+
+	c.invalidate(created.Id, created)
+
+	return created, nil
+}
+
+func (c *cachingRacesRepo) Update(ctx context.Context, race *racing.Race, fields []string) (*racing.Race, error) {
+	// The race as it was is needed to find the lists it's leaving. Races
+	// that can't be read aren't written, so no list is dropped for them.
+	existing, err := c.next.Get(ctx, race.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := c.next.Update(ctx, race, fields)
+	if err != nil {
+		c.invalidateAll()
+		return nil, err
+	}
+
+	c.invalidate(race.Id, existing, updated)
+
+	return updated, nil
+}
+
+func (c *cachingRacesRepo) Delete(ctx context.Context, id int64) error {
+	existing, err := c.next.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.next.Delete(ctx, id); err != nil {
+		c.invalidateAll()
+		return err
+	}
+
+	c.invalidate(id, existing)
+
+	return nil
+}
+
+// invalidate drops the cached lists a write may have changed: those holding
+// the race written, and those whose filter selects it, as it was before or
+// after the write. Lists being fetched while writing aren't cached.
+func (c *cachingRacesRepo) invalidate(id int64, races ...*racing.Race) {
+	now := c.clock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+
+		if el.Value.(*cacheEntry).affectedBy(id, races, now) {
+			c.remove(el)
+		}
+
+		el = next
+	}
+}
+
+// invalidateAll drops every cached list, after a write that failed. It may
+// have been applied regardless, such as when committing it failed, and what
+// it changed isn't known.
+func (c *cachingRacesRepo) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// affectedBy reports whether writing the race of the given ID, which was or
+// became each of races, may change the entry.
+func (e *cacheEntry) affectedBy(id int64, races []*racing.Race, now time.Time) bool {
+	for _, race := range e.races {
+		if id != 0 && race.Id == id {
+			return true
+		}
+	}
+
+	for _, race := range races {
+		if race != nil && MatchesFilter(race, e.filter, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listKey identifies the page of races a list request selects. Requests
+// selecting the same page, differing only in how they're written, share a
+// key.
+func listKey(in *racing.ListRacesRequest) (string, error) {
+	order, err := parseOrderBy(in.OrderBy)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := pageSize(in.PageSize)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := queryHash(in.Filter, order)
+	if err != nil {
+		return "", err
+	}
+
+	return hash + "|" + strconv.Itoa(size) + "|" + in.PageToken, nil
+}
+
+// cloneRaces returns a copy of each race, so cached races aren't changed by
+// their callers.
+func cloneRaces(races []*racing.Race) []*racing.Race {
+	if races == nil {
+		return nil
+	}
+
+	clones := make([]*racing.Race, 0, len(races))
+
+	for _, race := range races {
+		clones = append(clones, proto.Clone(race).(*racing.Race))
+	}
+
+	return clones
+}
@@ -0,0 +1,387 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// gatedRepo counts the lists made of a repository, and can hold up the next
+// of them until released.
+type gatedRepo struct {
+	db.RacesRepo
+
+	mu    sync.Mutex
+	lists int
+	gate  *gate
+}
+
+// gate holds up a list. started is closed when the list is held up, and the
+// list continues once release is closed, or fails once its context ends.
+type gate struct {
+	started, release chan struct{}
+}
+
+// hold holds up the next list made.
+func (r *gatedRepo) hold() *gate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gate = &gate{started: make(chan struct{}), release: make(chan struct{})}
+
+	return r.gate
+}
+
+func (r *gatedRepo) listCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lists
+}
+
+func (r *gatedRepo) List(ctx context.Context, in *racing.ListRacesRequest) ([]*racing.Race, string, error) {
+	r.mu.Lock()
+	r.lists++
+	g := r.gate
+	r.gate = nil
+	r.mu.Unlock()
+
+	if g != nil {
+		close(g.started)
+
+		select {
+		case <-g.release:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+
+	return r.RacesRepo.List(ctx, in)
+}
+
+// listResult is the outcome of a list made in the background.
+type listResult struct {
+	races []*racing.Race
+	err   error
+}
+
+// listAsync lists races in the background.
+func listAsync(ctx context.Context, r db.RacesRepo, in *racing.ListRacesRequest) <-chan listResult {
+	result := make(chan listResult, 1)
+
+	go func() {
+		races, _, err := r.List(ctx, in)
+		result <- listResult{races, err}
+	}()
+
+	return result
+}
+
+// newCachingRepo returns a caching repository in front of a gated memory
+// repository seeded with a race, and the registry its metrics are in.
+func newCachingRepo(t *testing.T) (db.RacesRepo, *gatedRepo, *prometheus.Registry) {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	next := &gatedRepo{RacesRepo: db.NewMemoryRacesRepo(db.WithSeeder(func() ([]*racing.Race, error) {
+		return []*racing.Race{
+			{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(time.Now().Add(time.Hour))},
+		}, nil
+	}))}
+
+	r := db.NewCachingRacesRepo(next, 10, time.Hour, db.WithMetrics(reg))
+	if err := r.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	return r, next, reg
+}
+
+// lookups returns how many cache lookups had the given result.
+func lookups(t *testing.T, reg *prometheus.Registry, result string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "racing_db_cache_lookups_total" {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestCachingRacesRepo(t *testing.T) {
+	dbtest.RunRacesRepoSuite(t, func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo {
+		return db.NewCachingRacesRepo(db.NewMemoryRacesRepo(opts...), 10, time.Hour, opts...)
+	})
+}
+
+func TestCachingRacesRepoCachesLists(t *testing.T) {
+	r, next, _ := newCachingRepo(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := r.List(ctx, &racing.ListRacesRequest{}); err != nil {
+			t.Fatalf("List: %v", err)
+		}
+	}
+
+	if lists := next.listCount(); lists != 1 {
+		t.Errorf("repository listed %d times, want 1", lists)
+	}
+}
+
+func TestCachingRacesRepoWriteDuringList(t *testing.T) {
+	r, next, _ := newCachingRepo(t)
+	ctx := context.Background()
+
+	g := next.hold()
+	result := listAsync(ctx, r, &racing.ListRacesRequest{})
+	<-g.started
+
+	// The race is created after the list began, so may be missing from it.
+	if _, err := r.Create(ctx, &racing.Race{MeetingId: 1, Name: "Bravo", Number: 2, Visible: true, AdvertisedStartTime: timestamppb.New(time.Now().Add(time.Hour))}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	close(g.release)
+	if res := <-result; res.err != nil {
+		t.Fatalf("List: %v", res.err)
+	}
+
+	// So that list isn't cached, and the next lists again.
+	races, _, err := r.List(ctx, &racing.ListRacesRequest{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	if len(races) != 2 {
+		t.Errorf("List after Create = %v, want both races", races)
+	}
+
+	if lists := next.listCount(); lists != 2 {
+		t.Errorf("repository listed %d times, want 2", lists)
+	}
+}
+
+func TestCachingRacesRepoCancelledLeader(t *testing.T) {
+	r, next, reg := newCachingRepo(t)
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	defer cancelLeader()
+
+	g := next.hold()
+	leader := listAsync(leaderCtx, r, &racing.ListRacesRequest{})
+	<-g.started
+
+	waiter := listAsync(context.Background(), r, &racing.ListRacesRequest{})
+
+	// The waiter is left waiting on the leader's list.
+	for deadline := time.Now().Add(5 * time.Second); lookups(t, reg, "shared") < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("waiter never shared the leader's list")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancelLeader()
+
+	if res := <-leader; !errors.Is(res.err, context.Canceled) {
+		t.Errorf("leader's List = %v, want context.Canceled", res.err)
+	}
+
+	// The waiter's context hasn't ended, so it lists again for itself.
+	res := <-waiter
+	if res.err != nil || len(res.races) != 1 {
+		t.Errorf("waiter's List = %v, %v, want the race", res.races, res.err)
+	}
+
+	if lists := next.listCount(); lists != 2 {
+		t.Errorf("repository listed %d times, want 2", lists)
+	}
+}
+
+func TestCachingRacesRepoWriteToMissingRace(t *testing.T) {
+	r, next, _ := newCachingRepo(t)
+	ctx := context.Background()
+
+	g := next.hold()
+	result := listAsync(ctx, r, &racing.ListRacesRequest{})
+	<-g.started
+
+	if _, err := r.Update(ctx, &racing.Race{Id: 99, Name: "Missing"}, []string{"name"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Update of a missing race = %v, want ErrNotFound", err)
+	}
+
+	if err := r.Delete(ctx, 99); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Delete of a missing race = %v, want ErrNotFound", err)
+	}
+
+	close(g.release)
+	if res := <-result; res.err != nil {
+		t.Fatalf("List: %v", res.err)
+	}
+
+	// Nothing was written, so the list is cached regardless.
+	if _, _, err := r.List(ctx, &racing.ListRacesRequest{}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	if lists := next.listCount(); lists != 1 {
+		t.Errorf("repository listed %d times, want 1", lists)
+	}
+}
+
+// errCommit fails the writes of a committingRepo.
+var errCommit = errors.New("commit failed")
+
+// committingRepo applies writes, yet reports them failed, as when committing
+// them fails after they were applied.
+type committingRepo struct {
+	db.RacesRepo
+}
+
+func (r committingRepo) Create(ctx context.Context, race *racing.Race) (*racing.Race, error) {
+	if _, err := r.RacesRepo.Create(ctx, race); err != nil {
+		return nil, err
+	}
+	return nil, errCommit
+}
+
+func (r committingRepo) Update(ctx context.Context, race *racing.Race, fields []string) (*racing.Race, error) {
+	if _, err := r.RacesRepo.Update(ctx, race, fields); err != nil {
+		return nil, err
+	}
+	return nil, errCommit
+}
+
+func (r committingRepo) Delete(ctx context.Context, id int64) error {
+	if err := r.RacesRepo.Delete(ctx, id); err != nil {
+		return err
+	}
+	return errCommit
+}
+
+func TestCachingRacesRepoFailedWrite(t *testing.T) {
+	start := timestamppb.New(time.Now().Add(time.Hour))
+	hidden := false
+
+	// Lists the writes change, other than by the races in them.
+	lists := []*racing.ListRacesRequest{
+		{},
+		{Filter: &racing.ListRacesRequestFilter{Visible: &hidden}},
+		{Filter: &racing.ListRacesRequestFilter{MeetingIds: []int64{2}}},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		write func(ctx context.Context, r db.RacesRepo) error
+	}{
+		{"create", func(ctx context.Context, r db.RacesRepo) error {
+			_, err := r.Create(ctx, &racing.Race{MeetingId: 2, Name: "Bravo", Number: 1, Visible: true, AdvertisedStartTime: start})
+			return err
+		}},
+		{"update", func(ctx context.Context, r db.RacesRepo) error {
+			_, err := r.Update(ctx, &racing.Race{Id: 1, Visible: false}, []string{"visible"})
+			return err
+		}},
+		{"delete", func(ctx context.Context, r db.RacesRepo) error {
+			return r.Delete(ctx, 1)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			next := db.NewMemoryRacesRepo(db.WithSeeder(func() ([]*racing.Race, error) {
+				return []*racing.Race{{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: start}}, nil
+			}))
+
+			r := db.NewCachingRacesRepo(committingRepo{next}, 10, time.Hour)
+			if err := r.Init(ctx); err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+
+			for _, in := range lists {
+				if _, _, err := r.List(ctx, in); err != nil {
+					t.Fatalf("List: %v", err)
+				}
+			}
+
+			if err := tc.write(ctx, r); !errors.Is(err, errCommit) {
+				t.Fatalf("%s = %v, want errCommit", tc.name, err)
+			}
+
+			// The write was applied, so every list shows it.
+			for _, in := range lists {
+				cached, _, err := r.List(ctx, in)
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+
+				want, _, err := next.List(ctx, in)
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+
+				if len(cached) != len(want) {
+					t.Errorf("List(%v) after a failed %s = %v, want %v", in, tc.name, cached, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCachingRacesRepoStatusFilteredList(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	next := db.NewMemoryRacesRepo(db.WithClock(clock), db.WithSeeder(func() ([]*racing.Race, error) {
+		return []*racing.Race{
+			{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(-time.Hour))},
+			{Id: 2, MeetingId: 1, Name: "Bravo", Number: 2, Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(time.Hour))},
+			{Id: 3, MeetingId: 1, Name: "Charlie", Number: 3, Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(2 * time.Hour))},
+		}, nil
+	}))
+
+	r := db.NewCachingRacesRepo(next, 10, 24*time.Hour, db.WithClock(clock))
+	if err := r.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	closed := &racing.ListRacesRequest{Filter: &racing.ListRacesRequestFilter{Statuses: []racing.Race_Status{racing.Race_CLOSED}}}
+
+	if races, _, err := r.List(ctx, closed); err != nil || len(races) != 1 {
+		t.Fatalf("List of closed races = %v, %v, want race 1", races, err)
+	}
+
+	// Race 2 starting closes it, though it wasn't in the list.
+	now = now.Add(time.Hour + time.Minute)
+
+	if races, _, err := r.List(ctx, closed); err != nil || len(races) != 2 {
+		t.Errorf("List of closed races once race 2 starts = %v, %v, want races 1 and 2", races, err)
+	}
+}
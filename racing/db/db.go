@@ -1,30 +1,179 @@
 package db
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v2"
 	"syreclabs.com/go/faker"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
 )
 
-func (r *racesRepo) seed() error {
-	statement, err := r.db.Prepare(`CREATE TABLE IF NOT EXISTS races (id INTEGER PRIMARY KEY, meeting_id INTEGER, name TEXT, number INTEGER, visible INTEGER, advertised_start_time DATETIME)`)
-	if err == nil {
-		_, err = statement.Exec()
+// Seeder produces the races a repository is seeded with when initialised.
+type Seeder func() ([]*racing.Race, error)
+
+// DemoSeeder generates 100 random races, advertised to start between a day
+// before and two days after the reference time, each numbered uniquely within
+// its meeting. The same seed and reference time always generate the same
+// races.
+func DemoSeeder(seed int64, reference time.Time) Seeder {
+	return func() ([]*racing.Race, error) {
+		faker.Seed(seed)
+
+		races := make([]*racing.Race, 0, 100)
+		taken := make(map[[2]int64]bool)
+
+		for i := 1; i <= 100; i++ {
+			// 10 meetings of 12 races leave room for all 100, so drawing
+			// again while the number is taken ends.
+			meetingID, number := between(1, 10), between(1, 12)
+			for taken[[2]int64{meetingID, number}] {
+				meetingID, number = between(1, 10), between(1, 12)
+			}
+			taken[[2]int64{meetingID, number}] = true
+
+			races = append(races, &racing.Race{
+				Id:                  int64(i),
+				MeetingId:           meetingID,
+				Name:                faker.Team().Name(),
+				Number:              number,
+				Visible:             between(0, 1) == 1,
+				AdvertisedStartTime: timestamppb.New(faker.Time().Between(reference.AddDate(0, 0, -1), reference.AddDate(0, 0, 2))),
+			})
+		}
+
+		return races, nil
+	}
+}
+
+// between returns a random number in the inclusive range [min, max].
+func between(min, max int) int64 {
+	n, _ := strconv.ParseInt(faker.Number().Between(min, max), 10, 64)
+
+	return n
+}
+
+// fixtureRace is a race as written in a fixture file.
+type fixtureRace struct {
+	ID                  int64     `json:"id" yaml:"id"`
+	MeetingID           int64     `json:"meeting_id" yaml:"meeting_id"`
+	Name                string    `json:"name" yaml:"name"`
+	Number              int64     `json:"number" yaml:"number"`
+	Visible             bool      `json:"visible" yaml:"visible"`
+	AdvertisedStartTime time.Time `json:"advertised_start_time" yaml:"advertised_start_time"`
+}
+
+// FixtureSeeder loads races from a JSON or YAML file, chosen by its extension,
+// holding a "races" list.
+func FixtureSeeder(path string) Seeder {
+	return func() ([]*racing.Race, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var fixture struct {
+			Races []fixtureRace `json:"races" yaml:"races"`
+		}
+
+		switch ext := strings.ToLower(filepath.Ext(path)); ext {
+		case ".json":
+			err = json.Unmarshal(b, &fixture)
+		case ".yaml", ".yml":
+			err = yaml.UnmarshalStrict(b, &fixture)
+		default:
+			return nil, fmt.Errorf("unsupported fixture format %q", ext)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("loading fixture %s: %w", path, err)
+		}
+
+		races := make([]*racing.Race, 0, len(fixture.Races))
+
+		for _, race := range fixture.Races {
+			races = append(races, &racing.Race{
+				Id:                  race.ID,
+				MeetingId:           race.MeetingID,
+				Name:                race.Name,
+				Number:              race.Number,
+				Visible:             race.Visible,
+				AdvertisedStartTime: timestamppb.New(race.AdvertisedStartTime),
+			})
+		}
+
+		return races, nil
+	}
+}
+
+// seed inserts the seeder's races, if any. Races whose ID, or meeting and
+// number, are already taken are left untouched, so seeding an existing
+// database is harmless.
+func (r *racesRepo) seed(ctx context.Context) error {
+	if r.seeder == nil {
+		return nil
+	}
+
+	races, err := r.seeder()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement, err := tx.PrepareContext(ctx, r.dialect.rebind(getRaceQueries()[racesSeed]))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	// Races with an ID are inserted first, so those without are assigned IDs
+	// that can't collide with them.
+	var unnumbered []*racing.Race
+
+	for _, race := range races {
+		if race.Id == 0 {
+			unnumbered = append(unnumbered, race)
+			continue
+		}
+
+		if _, err := statement.ExecContext(
+			ctx,
+			race.Id,
+			race.MeetingId,
+			race.Name,
+			race.Number,
+			race.Visible,
+			formatTime(race.AdvertisedStartTime),
+			r.modifiedTime(),
+		); err != nil {
+			return err
+		}
+	}
+
+	if r.dialect.resetSequence != "" {
+		if _, err := tx.ExecContext(ctx, r.dialect.resetSequence); err != nil {
+			return err
+		}
 	}
 
-	for i := 1; i <= 100; i++ {
-		statement, err = r.db.Prepare(`INSERT OR IGNORE INTO races(id, meeting_id, name, number, visible, advertised_start_time) VALUES (?,?,?,?,?,?)`)
-		if err == nil {
-			_, err = statement.Exec(
-				i,
-				faker.Number().Between(1, 10),
-				faker.Team().Name(),
-				faker.Number().Between(1, 12),
-				faker.Number().Between(0, 1),
-				faker.Time().Between(time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 2)).Format(time.RFC3339),
-			)
+	for _, race := range unnumbered {
+		if _, err := r.insert(ctx, tx, race); err != nil {
+			return r.uniqueError(err, race)
 		}
 	}
 
-	return err
+	return tx.Commit()
 }
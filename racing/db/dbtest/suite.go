@@ -0,0 +1,387 @@
+// Package dbtest provides a conformance suite for races repositories, so
+// every implementation can be held to the same behaviour. For example:
+//
+//	func TestMemoryRacesRepo(t *testing.T) {
+//		dbtest.RunRacesRepoSuite(t, func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo {
+//			return db.NewMemoryRacesRepo(opts...)
+//		})
+//	}
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// NewRacesRepoFunc creates an empty races repository for a single test,
+// configured with the given options. It should not be initialised.
+type NewRacesRepoFunc func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo
+
+// now is the fixed time the suite's repositories derive statuses against.
+var now = time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)
+
+// fixtureRaces returns the races the suite seeds its repositories with.
+func fixtureRaces() []*racing.Race {
+	at := func(d time.Duration) *timestamppb.Timestamp { return timestamppb.New(now.Add(d)) }
+
+	return []*racing.Race{
+		{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: at(-2 * time.Hour)},
+		{Id: 2, MeetingId: 1, Name: "Bravo", Number: 2, Visible: false, AdvertisedStartTime: at(-time.Hour)},
+		{Id: 3, MeetingId: 1, Name: "Charlie", Number: 3, Visible: true, AdvertisedStartTime: at(time.Hour)},
+		{Id: 4, MeetingId: 2, Name: "Delta", Number: 1, Visible: true, AdvertisedStartTime: at(time.Hour)},
+		{Id: 5, MeetingId: 2, Name: "Echo", Number: 2, Visible: false, AdvertisedStartTime: at(2 * time.Hour)},
+		{Id: 6, MeetingId: 3, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: at(3 * time.Hour)},
+		{Id: 7, MeetingId: 3, Name: "Foxtrot", Number: 2, Visible: true, AdvertisedStartTime: at(-3 * time.Hour)},
+	}
+}
+
+// RunRacesRepoSuite runs the conformance suite against the repositories
+// created by newRepo.
+func RunRacesRepoSuite(t *testing.T, newRepo NewRacesRepoFunc) {
+	seeded := func(t *testing.T) db.RacesRepo {
+		t.Helper()
+
+		r := newRepo(t,
+			db.WithClock(func() time.Time { return now }),
+			db.WithSeeder(func() ([]*racing.Race, error) { return fixtureRaces(), nil }),
+		)
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		return r
+	}
+
+	t.Run("SeedsNothingByDefault", func(t *testing.T) {
+		r := newRepo(t)
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		assertIDs(t, list(t, r, &racing.ListRacesRequest{}))
+	})
+
+	t.Run("SeedSkipsTakenNumbers", func(t *testing.T) {
+		races := fixtureRaces()
+		races = append(races, &racing.Race{Id: 8, MeetingId: 1, Name: "Copy", Number: 1, AdvertisedStartTime: timestamppb.New(now)})
+
+		r := newRepo(t,
+			db.WithClock(func() time.Time { return now }),
+			db.WithSeeder(func() ([]*racing.Race, error) { return races, nil }),
+		)
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		assertIDs(t, list(t, r, &racing.ListRacesRequest{OrderBy: "id"}), 1, 2, 3, 4, 5, 6, 7)
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		r := seeded(t)
+
+		race, err := r.Get(context.Background(), 3)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		want := fixtureRaces()[2]
+		want.Status = racing.Race_OPEN
+		want.Version = 1
+		want.LastModified = timestamppb.New(now)
+
+		if !proto.Equal(race, want) {
+			t.Errorf("Get = %v, want %v", race, want)
+		}
+
+		if _, err := r.Get(context.Background(), 99); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("Get of a missing race = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		r := seeded(t)
+		visible, hidden := true, false
+
+		for _, tc := range []struct {
+			name   string
+			filter *racing.ListRacesRequestFilter
+			want   []int64
+		}{
+			{"None", nil, []int64{7, 1, 2, 3, 4, 5, 6}},
+			{"MeetingIDs", &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 3}}, []int64{7, 1, 2, 3, 6}},
+			{"Visible", &racing.ListRacesRequestFilter{Visible: &visible}, []int64{7, 1, 3, 4, 6}},
+			{"Hidden", &racing.ListRacesRequestFilter{Visible: &hidden}, []int64{2, 5}},
+			{"Open", &racing.ListRacesRequestFilter{Statuses: []racing.Race_Status{racing.Race_OPEN}}, []int64{3, 4, 5, 6}},
+			{"Closed", &racing.ListRacesRequestFilter{Statuses: []racing.Race_Status{racing.Race_CLOSED}}, []int64{7, 1, 2}},
+			{"AnyStatus", &racing.ListRacesRequestFilter{Statuses: []racing.Race_Status{racing.Race_CLOSED, racing.Race_OPEN}}, []int64{7, 1, 2, 3, 4, 5, 6}},
+			{"Combined", &racing.ListRacesRequestFilter{
+				MeetingIds: []int64{1, 2},
+				Visible:    &visible,
+				Statuses:   []racing.Race_Status{racing.Race_OPEN},
+			}, []int64{3, 4}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				races := list(t, r, &racing.ListRacesRequest{Filter: tc.filter})
+				assertIDs(t, races, tc.want...)
+
+				for _, race := range races {
+					want := racing.Race_CLOSED
+					if race.AdvertisedStartTime.AsTime().After(now) {
+						want = racing.Race_OPEN
+					}
+
+					if race.Status != want {
+						t.Errorf("race %d status = %v, want %v", race.Id, race.Status, want)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("OrderBy", func(t *testing.T) {
+		r := seeded(t)
+
+		for _, tc := range []struct {
+			orderBy string
+			want    []int64
+		}{
+			{"", []int64{7, 1, 2, 3, 4, 5, 6}},
+			{"advertised_start_time desc", []int64{6, 5, 3, 4, 2, 1, 7}},
+			{"name", []int64{1, 6, 2, 3, 4, 5, 7}},
+			{"name desc, id desc", []int64{7, 5, 4, 3, 2, 6, 1}},
+			{"meeting_id desc, number", []int64{6, 7, 4, 5, 1, 2, 3}},
+			{"visible, advertised_start_time", []int64{2, 5, 7, 1, 3, 4, 6}},
+		} {
+			t.Run(tc.orderBy, func(t *testing.T) {
+				assertIDs(t, list(t, r, &racing.ListRacesRequest{OrderBy: tc.orderBy}), tc.want...)
+			})
+		}
+
+		for _, orderBy := range []string{"status", "name sideways", "name, name", "name,"} {
+			if _, _, err := r.List(context.Background(), &racing.ListRacesRequest{OrderBy: orderBy}); !errors.Is(err, db.ErrInvalidOrderBy) {
+				t.Errorf("List ordered by %q = %v, want ErrInvalidOrderBy", orderBy, err)
+			}
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		r := seeded(t)
+		visible := true
+
+		for _, req := range []*racing.ListRacesRequest{
+			{},
+			{OrderBy: "name desc"},
+			{OrderBy: "visible, advertised_start_time desc"},
+			{OrderBy: "meeting_id, number desc", Filter: &racing.ListRacesRequestFilter{Visible: &visible}},
+		} {
+			want := list(t, r, req)
+
+			var got []*racing.Race
+
+			page := proto.Clone(req).(*racing.ListRacesRequest)
+			page.PageSize = 2
+
+			for {
+				races, next, err := r.List(context.Background(), page)
+				if err != nil {
+					t.Fatalf("List(%v): %v", page, err)
+				}
+
+				if len(races) > 2 {
+					t.Fatalf("List(%v) returned %d races, want at most 2", page, len(races))
+				}
+
+				got = append(got, races...)
+
+				if next == "" {
+					break
+				}
+
+				page.PageToken = next
+			}
+
+			assertIDs(t, got, ids(want)...)
+		}
+
+		_, token, err := r.List(context.Background(), &racing.ListRacesRequest{PageSize: 2})
+		if err != nil || token == "" {
+			t.Fatalf("List = %q, %v, want a page token", token, err)
+		}
+
+		for _, req := range []*racing.ListRacesRequest{
+			{PageSize: 2, PageToken: token, OrderBy: "name"},
+			{PageSize: 2, PageToken: token, Filter: &racing.ListRacesRequestFilter{Visible: &visible}},
+			{PageSize: 2, PageToken: "not a token"},
+		} {
+			if _, _, err := r.List(context.Background(), req); !errors.Is(err, db.ErrInvalidPageToken) {
+				t.Errorf("List(%v) = %v, want ErrInvalidPageToken", req, err)
+			}
+		}
+
+		if _, _, err := r.List(context.Background(), &racing.ListRacesRequest{PageSize: -1}); !errors.Is(err, db.ErrInvalidPageSize) {
+			t.Errorf("List with a negative page size = %v, want ErrInvalidPageSize", err)
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		r := seeded(t)
+		ctx := context.Background()
+
+		race := &racing.Race{MeetingId: 4, Name: "Golf", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(time.Hour))}
+
+		created, err := r.Create(ctx, race)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		want := proto.Clone(race).(*racing.Race)
+		want.Id = 8
+		want.Status = racing.Race_OPEN
+		want.Version = 1
+		want.LastModified = timestamppb.New(now)
+
+		if !proto.Equal(created, want) {
+			t.Errorf("Create = %v, want %v", created, want)
+		}
+
+		if got, err := r.Get(ctx, created.Id); err != nil || !proto.Equal(got, want) {
+			t.Errorf("Get after Create = %v, %v, want %v", got, err, want)
+		}
+
+		if _, err := r.Create(ctx, &racing.Race{MeetingId: 1, Name: "Copy", Number: 2, AdvertisedStartTime: timestamppb.New(now)}); !errors.Is(err, db.ErrAlreadyExists) {
+			t.Errorf("Create of a duplicate = %v, want ErrAlreadyExists", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		r := seeded(t)
+		ctx := context.Background()
+
+		updated, err := r.Update(ctx, &racing.Race{Id: 2, Name: "Ignored", Visible: true, AdvertisedStartTime: timestamppb.New(now.Add(time.Hour))}, []string{"visible", "advertised_start_time"})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		want := fixtureRaces()[1]
+		want.Visible = true
+		want.AdvertisedStartTime = timestamppb.New(now.Add(time.Hour))
+		want.Status = racing.Race_OPEN
+		want.Version = 2
+		want.LastModified = timestamppb.New(now)
+
+		if !proto.Equal(updated, want) {
+			t.Errorf("Update = %v, want %v", updated, want)
+		}
+
+		replacement := &racing.Race{Id: 2, MeetingId: 5, Name: "Hotel", Number: 9, AdvertisedStartTime: timestamppb.New(now.Add(-time.Hour))}
+
+		updated, err = r.Update(ctx, replacement, nil)
+		if err != nil {
+			t.Fatalf("Update of all fields: %v", err)
+		}
+
+		want = proto.Clone(replacement).(*racing.Race)
+		want.Status = racing.Race_CLOSED
+		want.Version = 3
+		want.LastModified = timestamppb.New(now)
+
+		if !proto.Equal(updated, want) {
+			t.Errorf("Update of all fields = %v, want %v", updated, want)
+		}
+
+		if _, err := r.Update(ctx, &racing.Race{Id: 3, Number: 1}, []string{"number"}); !errors.Is(err, db.ErrAlreadyExists) {
+			t.Errorf("Update to a duplicate = %v, want ErrAlreadyExists", err)
+		}
+
+		if _, err := r.Update(ctx, &racing.Race{Id: 3}, []string{"status"}); !errors.Is(err, db.ErrInvalidUpdateMask) {
+			t.Errorf("Update of status = %v, want ErrInvalidUpdateMask", err)
+		}
+
+		if _, err := r.Update(ctx, &racing.Race{Id: 99}, []string{"name"}); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("Update of a missing race = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		r := seeded(t)
+		ctx := context.Background()
+
+		if err := r.Delete(ctx, 4); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		if _, err := r.Get(ctx, 4); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+
+		if err := r.Delete(ctx, 4); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("Delete of a missing race = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		r := seeded(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, _, err := r.List(ctx, &racing.ListRacesRequest{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("List with a cancelled context = %v, want context.Canceled", err)
+		}
+
+		if _, err := r.Create(ctx, &racing.Race{MeetingId: 9, Name: "India", Number: 1, AdvertisedStartTime: timestamppb.New(now)}); !errors.Is(err, context.Canceled) {
+			t.Errorf("Create with a cancelled context = %v, want context.Canceled", err)
+		}
+	})
+}
+
+// list returns every race on the first page of a list request.
+func list(t *testing.T, r db.RacesRepo, req *racing.ListRacesRequest) []*racing.Race {
+	t.Helper()
+
+	races, _, err := r.List(context.Background(), req)
+	if err != nil {
+		t.Fatalf("List(%v): %v", req, err)
+	}
+
+	return races
+}
+
+// ids returns the IDs of races, in order.
+func ids(races []*racing.Race) []int64 {
+	ids := make([]int64, 0, len(races))
+
+	for _, race := range races {
+		ids = append(ids, race.Id)
+	}
+
+	return ids
+}
+
+// assertIDs checks races have exactly the wanted IDs, in order.
+func assertIDs(t *testing.T, races []*racing.Race, want ...int64) {
+	t.Helper()
+
+	got := ids(races)
+
+	if len(got) != len(want) {
+		t.Errorf("got races %v, want %v", got, want)
+		return
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got races %v, want %v", got, want)
+			return
+		}
+	}
+}
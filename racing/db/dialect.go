@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Driver names of the databases races can be stored in.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+	// DriverMemory holds races in memory, rather than a database.
+	DriverMemory = "memory"
+)
+
+// dialect captures how the databases races can be stored in differ. Queries
+// are written once, with "?" placeholders, and adapted by each dialect.
+type dialect struct {
+	// name is the directory holding the dialect's migrations.
+	name string
+	// system identifies the database in trace spans.
+	system attribute.KeyValue
+	// numberedParams is set when placeholders are written $1, $2, ...
+	numberedParams bool
+	// datetime wraps a time expression so it compares chronologically.
+	datetime func(expr string) string
+	// returningID is set when inserts report the new race's ID through a
+	// RETURNING clause, rather than the driver's LastInsertId.
+	returningID bool
+	// migrationsTable creates the table applied migrations are recorded in.
+	migrationsTable string
+	// resetSequence, when set, moves the races ID sequence past any IDs
+	// inserted explicitly.
+	resetSequence string
+	// uniqueViolation reports whether an error is the database refusing a
+	// write that breaks a unique constraint.
+	uniqueViolation func(err error) bool
+}
+
+var sqliteDialect = &dialect{
+	name:   "sqlite",
+	system: semconv.DBSystemSqlite,
+	// Times are stored as text, which may carry differing UTC offsets.
+	datetime:        func(expr string) string { return "datetime(" + expr + ")" },
+	migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at DATETIME)`,
+	// The driver's error type needs cgo, so it's matched by its message,
+	// leaving the package buildable without it.
+	uniqueViolation: func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+	},
+}
+
+var postgresDialect = &dialect{
+	name:            "postgres",
+	system:          semconv.DBSystemPostgreSQL,
+	numberedParams:  true,
+	datetime:        func(expr string) string { return expr },
+	returningID:     true,
+	migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TIMESTAMPTZ)`,
+	resetSequence:   `SELECT setval(pg_get_serial_sequence('races', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM races`,
+	uniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+}
+
+// dialectFor returns the dialect of the named driver.
+func dialectFor(driver string) (*dialect, error) {
+	switch driver {
+	case DriverSQLite:
+		return sqliteDialect, nil
+	case DriverPostgres:
+		return postgresDialect, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+}
+
+// rebind rewrites a query's "?" placeholders into the dialect's form.
+func (d *dialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,387 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// memoryRacesRepo is a races repository held entirely in memory. It behaves
+// as the SQL repositories do, but needs neither cgo nor a database, which
+// suits tests and local development.
+type memoryRacesRepo struct {
+	repoOptions
+
+	init  sync.Once
+	mu    sync.RWMutex
+	races map[int64]*racing.Race
+}
+
+// NewMemoryRacesRepo creates a new races repository, held in memory.
+func NewMemoryRacesRepo(opts ...RacesRepoOption) RacesRepo {
+	return &memoryRacesRepo{
+		repoOptions: newRepoOptions(opts),
+		races:       make(map[int64]*racing.Race),
+	}
+}
+
+// Init seeds the race repository, if configured to.
+func (r *memoryRacesRepo) Init(ctx context.Context) error {
+	var err error
+
+	r.init.Do(func() {
+		if err = ctx.Err(); err != nil || r.seeder == nil {
+			return
+		}
+
+		var races []*racing.Race
+
+		races, err = r.seeder()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		// As with the SQL repositories, races with an ID are stored first and
+		// left untouched if their ID, or meeting and number, are taken, and
+		// those without are assigned the next.
+		for _, race := range races {
+			if _, ok := r.races[race.Id]; race.Id != 0 && !ok && r.checkDuplicate(race) == nil {
+				r.store(race, 1)
+			}
+		}
+
+		for _, race := range races {
+			if race.Id == 0 {
+				if err = r.checkDuplicate(race); err != nil {
+					return
+				}
+
+				unnumbered := proto.Clone(race).(*racing.Race)
+				unnumbered.Id = r.nextID()
+				r.store(unnumbered, 1)
+			}
+		}
+	})
+
+	return err
+}
+
+func (r *memoryRacesRepo) List(ctx context.Context, in *racing.ListRacesRequest) ([]*racing.Race, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	order, err := parseOrderBy(in.OrderBy)
+	if err != nil {
+		return nil, "", err
+	}
+
+	size, err := pageSize(in.PageSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := queryHash(in.Filter, order)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var after []interface{}
+
+	if in.PageToken != "" {
+		token, err := decodePageToken(in.PageToken, order, hash)
+		if err != nil {
+			return nil, "", err
+		}
+
+		after = token.Keys
+	}
+
+	now := r.clock()
+
+	r.mu.RLock()
+
+	var races []*racing.Race
+
+	for _, race := range r.races {
+		if !MatchesFilter(race, in.Filter, now) {
+			continue
+		}
+
+		if after != nil && compareKeys(orderKeys(race, order), after, order) <= 0 {
+			continue
+		}
+
+		races = append(races, r.load(race, now))
+	}
+
+	r.mu.RUnlock()
+
+	sort.Slice(races, func(i, j int) bool {
+		return compareKeys(orderKeys(races[i], order), orderKeys(races[j], order), order) < 0
+	})
+
+	if len(races) <= size {
+		return races, "", nil
+	}
+
+	races = races[:size]
+
+	next, err := encodePageToken(races[size-1], order, hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return races, next, nil
+}
+
+func (r *memoryRacesRepo) Get(ctx context.Context, id int64) (*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	race, ok := r.races[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return r.load(race, r.clock()), nil
+}
+
+func (r *memoryRacesRepo) Create(ctx context.Context, race *racing.Race) (*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	created := proto.Clone(race).(*racing.Race)
+	created.Id = 0
+
+	if err := r.checkDuplicate(created); err != nil {
+		return nil, err
+	}
+
+	created.Id = r.nextID()
+
+	return r.load(r.store(created, 1), r.clock()), nil
+}
+
+func (r *memoryRacesRepo) Update(ctx context.Context, race *racing.Race, fields []string) (*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		fields = updatableFields
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.races[race.Id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	updated := proto.Clone(existing).(*racing.Race)
+	if err := applyFields(updated, race, fields); err != nil {
+		return nil, err
+	}
+
+	if err := r.checkDuplicate(updated); err != nil {
+		return nil, err
+	}
+
+	return r.load(r.store(updated, existing.Version+1), r.clock()), nil
+}
+
+func (r *memoryRacesRepo) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.races[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(r.races, id)
+
+	return nil
+}
+
+// store saves a copy of the race as the given version, last modified now,
+// keeping only what the SQL repositories would: no status, and times to the
+// second.
+func (r *memoryRacesRepo) store(race *racing.Race, version int64) *racing.Race {
+	stored := proto.Clone(race).(*racing.Race)
+	stored.Status = racing.Race_STATUS_UNSPECIFIED
+	stored.AdvertisedStartTime = timestamppb.New(race.AdvertisedStartTime.AsTime().Truncate(time.Second))
+	stored.Version = version
+	stored.LastModified = timestamppb.New(r.clock().Truncate(time.Second))
+
+	r.races[stored.Id] = stored
+
+	return stored
+}
+
+// load returns a copy of a stored race, with its status derived.
+func (r *memoryRacesRepo) load(race *racing.Race, now time.Time) *racing.Race {
+	loaded := proto.Clone(race).(*racing.Race)
+	loaded.Status = raceStatus(race.AdvertisedStartTime.AsTime(), now)
+
+	return loaded
+}
+
+// nextID returns the ID a new race is assigned, one past the highest in use.
+func (r *memoryRacesRepo) nextID() int64 {
+	var max int64
+
+	for id := range r.races {
+		if id > max {
+			max = id
+		}
+	}
+
+	return max + 1
+}
+
+// checkDuplicate ensures no other race shares the race's meeting and number.
+func (r *memoryRacesRepo) checkDuplicate(race *racing.Race) error {
+	for id, other := range r.races {
+		if id != race.Id && other.MeetingId == race.MeetingId && other.Number == race.Number {
+			return duplicateError(id, race)
+		}
+	}
+
+	return nil
+}
+
+// MatchesFilter reports whether a race is selected by the filter at the given
+// time, as every repository's List selects races.
+func MatchesFilter(race *racing.Race, filter *racing.ListRacesRequestFilter, now time.Time) bool {
+	if filter == nil {
+		return true
+	}
+
+	if len(filter.MeetingIds) > 0 {
+		found := false
+
+		for _, meetingID := range filter.MeetingIds {
+			if race.MeetingId == meetingID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Visible != nil && race.Visible != filter.GetVisible() {
+		return false
+	}
+
+	// Statuses are compared to the second, as the SQL repositories store
+	// and compare times.
+	var (
+		open        = race.AdvertisedStartTime.AsTime().After(now.Truncate(time.Second))
+		restricted  bool
+		statusMatch bool
+	)
+
+	for _, status := range filter.Statuses {
+		switch status {
+		case racing.Race_OPEN:
+			restricted = true
+			statusMatch = statusMatch || open
+		case racing.Race_CLOSED:
+			restricted = true
+			statusMatch = statusMatch || !open
+		}
+	}
+
+	return !restricted || statusMatch
+}
+
+// orderKeys returns a race's sort key for each order field.
+func orderKeys(race *racing.Race, order []orderField) []interface{} {
+	keys := make([]interface{}, 0, len(order))
+
+	for _, f := range order {
+		keys = append(keys, raceOrderColumns[f.field].key(race))
+	}
+
+	return keys
+}
+
+// compareKeys compares two races' sort keys under the given ordering,
+// returning a negative number when a sorts first, and a positive one when b
+// does.
+func compareKeys(a, b []interface{}, order []orderField) int {
+	for i, f := range order {
+		c := compareKey(a[i], b[i])
+		if f.desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// compareKey compares two sort keys of the same field.
+func compareKey(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		b, _ := b.(int64)
+
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		// Times are keyed in RFC3339 UTC, which sorts as text does.
+		b, _ := b.(string)
+
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case bool:
+		b, _ := b.(bool)
+
+		switch {
+		case !a && b:
+			return -1
+		case a && !b:
+			return 1
+		}
+	}
+
+	return 0
+}
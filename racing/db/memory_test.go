@@ -0,0 +1,14 @@
+package db_test
+
+import (
+	"testing"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+)
+
+func TestMemoryRacesRepo(t *testing.T) {
+	dbtest.RunRacesRepoSuite(t, func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo {
+		return db.NewMemoryRacesRepo(opts...)
+	})
+}
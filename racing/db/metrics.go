@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithMetrics records how long the repository's database queries take, in a
+// histogram registered with reg, and how often a caching repository's lookups
+// hit its cache. Repositories sharing reg share the metrics.
+func WithMetrics(reg prometheus.Registerer) RacesRepoOption {
+	queryDuration := register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "racing_db_query_duration_seconds",
+		Help:    "Time taken by races repository operations against the database, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})).(*prometheus.HistogramVec)
+
+	cacheLookups := register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "racing_db_cache_lookups_total",
+		Help: "Total number of race lists looked up in the cache, by result: hit, miss, or shared with a concurrent miss.",
+	}, []string{"result"})).(*prometheus.CounterVec)
+
+	return func(o *repoOptions) {
+		o.queryDuration = queryDuration
+		o.cacheLookups = cacheLookups
+	}
+}
+
+// register registers a collector with reg, returning the collector already
+// registered in its place, if any.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			panic(err)
+		}
+
+		return registered.ExistingCollector
+	}
+
+	return c
+}
+
+// observe records the duration of an operation begun at start, when metrics
+// are enabled.
+func (o *repoOptions) observe(operation string, start time.Time) {
+	if o.queryDuration == nil {
+		return
+	}
+
+	o.queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// lookedUp records the result of a cache lookup, when metrics are enabled.
+func (o *repoOptions) lookedUp(result string) {
+	if o.cacheLookups == nil {
+		return
+	}
+
+	o.cacheLookups.WithLabelValues(result).Inc()
+}
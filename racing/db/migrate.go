@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles holds the versioned schema migrations, in a directory per
+// dialect. Each version has an up and a down script, named
+// "<version>_<name>.<up|down>.sql".
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationCheck refuses applying a migration to data it can't hold, rather
+// than have the migration change or drop that data.
+type migrationCheck func(ctx context.Context, tx *sql.Tx, d *dialect) error
+
+// migrationChecks are run before applying the migration of the same name.
+var migrationChecks = map[string]migrationCheck{
+	"unique_race_numbers": checkRaceNumbers,
+}
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+
+	up, down string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies and rolls back schema migrations, recording the applied
+// versions in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    *dialect
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for the embedded migrations of the named
+// database driver.
+func NewMigrator(db *sql.DB, driver string) (*Migrator, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMigrator(db, d)
+}
+
+func newMigrator(db *sql.DB, d *dialect) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", d.name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+// loadMigrations reads the migrations in dir, ordered by version.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %q", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+
+		script, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down script", m.Version)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Up applies every pending migration, in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := m.apply(ctx, migrationChecks[migration.Name], migration.up, `INSERT INTO schema_migrations(version, name, applied_at) VALUES (?,?,?)`, migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("applying migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Down rolls back the given number of most recently applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if err := m.apply(ctx, nil, migration.down, `DELETE FROM schema_migrations WHERE version = ?`, migration.Version); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		steps--
+	}
+
+	return nil
+}
+
+// Status reports every known migration and when it was applied, if at all.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// apply runs a migration script and records it, in a single transaction,
+// once the check, if any, passes.
+func (m *Migrator) apply(ctx context.Context, check migrationCheck, script, record string, args ...interface{}) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if check != nil {
+		if err := check(ctx, tx, m.dialect); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, m.dialect.rebind(record), args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applied returns the applied migration versions, and when they were applied.
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if _, err := m.db.ExecContext(ctx, m.dialect.migrationsTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
@@ -0,0 +1,2 @@
+ALTER TABLE races DROP COLUMN last_modified;
+ALTER TABLE races DROP COLUMN version;
@@ -0,0 +1,2 @@
+ALTER TABLE races ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE races ADD COLUMN last_modified TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,4 @@
+-- Races were only kept unique by meeting and number when written through the
+-- API, so races seeded before this may share them. The migrator refuses to
+-- apply this while any do, listing them to be renumbered first.
+CREATE UNIQUE INDEX races_meeting_id_number ON races (meeting_id, number);
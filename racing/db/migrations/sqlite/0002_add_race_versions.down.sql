@@ -0,0 +1,11 @@
+CREATE TABLE races_without_versions (
+	id INTEGER PRIMARY KEY,
+	meeting_id INTEGER,
+	name TEXT,
+	number INTEGER,
+	visible INTEGER,
+	advertised_start_time DATETIME
+);
+INSERT INTO races_without_versions SELECT id, meeting_id, name, number, visible, advertised_start_time FROM races;
+DROP TABLE races;
+ALTER TABLE races_without_versions RENAME TO races;
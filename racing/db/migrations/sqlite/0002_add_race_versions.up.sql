@@ -0,0 +1,3 @@
+ALTER TABLE races ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE races ADD COLUMN last_modified DATETIME NOT NULL DEFAULT '1970-01-01T00:00:00Z';
+UPDATE races SET last_modified = strftime('%Y-%m-%dT%H:%M:%SZ', 'now');
@@ -0,0 +1 @@
+DROP INDEX races_meeting_id_number;
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// defaultRacesOrderBy is applied when the caller doesn't specify an ordering.
+const defaultRacesOrderBy = "advertised_start_time"
+
+// ErrInvalidOrderBy is returned when an order_by expression can't be parsed
+// or references a field that isn't sortable.
+var ErrInvalidOrderBy = errors.New("invalid order_by")
+
+// orderColumn describes how a sortable race field is compared in SQL.
+type orderColumn struct {
+	// column is the column the field is stored in.
+	column string
+	// datetime is set for time columns, which are compared by the dialect's
+	// datetime expressions.
+	datetime bool
+	// key extracts the field's sort key from a race.
+	key func(race *racing.Race) interface{}
+}
+
+// expr returns the SQL expression the field is sorted by.
+func (c orderColumn) expr(d *dialect) string {
+	if c.datetime {
+		return d.datetime(c.column)
+	}
+
+	return c.column
+}
+
+// param returns a placeholder expression comparable against expr.
+func (c orderColumn) param(d *dialect) string {
+	if c.datetime {
+		return d.datetime("?")
+	}
+
+	return "?"
+}
+
+// raceOrderColumns whitelists the fields races may be sorted by, mapping each
+// public field name to the SQL used to sort it. Caller input is only ever
+// used as a key into this map, never placed into the query itself.
+var raceOrderColumns = map[string]orderColumn{
+	"id": {
+		column: "id",
+		key:    func(race *racing.Race) interface{} { return race.Id },
+	},
+	"meeting_id": {
+		column: "meeting_id",
+		key:    func(race *racing.Race) interface{} { return race.MeetingId },
+	},
+	"name": {
+		column: "name",
+		key:    func(race *racing.Race) interface{} { return race.Name },
+	},
+	"number": {
+		column: "number",
+		key:    func(race *racing.Race) interface{} { return race.Number },
+	},
+	"visible": {
+		column: "visible",
+		key:    func(race *racing.Race) interface{} { return race.Visible },
+	},
+	"advertised_start_time": {
+		column:   "advertised_start_time",
+		datetime: true,
+		key: func(race *racing.Race) interface{} {
+			return race.GetAdvertisedStartTime().AsTime().Format(time.RFC3339)
+		},
+	},
+}
+
+// orderField is a single, validated term of an order_by expression.
+type orderField struct {
+	field string
+	desc  bool
+}
+
+// parseOrderBy parses an AIP-132 style order_by expression, such as
+// "advertised_start_time desc, number", into its validated terms.
+func parseOrderBy(orderBy string) ([]orderField, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		orderBy = defaultRacesOrderBy
+	}
+
+	var (
+		fields []orderField
+		seen   = make(map[string]bool)
+	)
+
+	for _, term := range strings.Split(orderBy, ",") {
+		parts := strings.Fields(term)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("%w: malformed term %q", ErrInvalidOrderBy, strings.TrimSpace(term))
+		}
+
+		field := orderField{field: parts[0]}
+		if _, ok := raceOrderColumns[field.field]; !ok {
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidOrderBy, field.field)
+		}
+
+		if seen[field.field] {
+			return nil, fmt.Errorf("%w: field %q specified more than once", ErrInvalidOrderBy, field.field)
+		}
+		seen[field.field] = true
+
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case "asc":
+			case "desc":
+				field.desc = true
+			default:
+				return nil, fmt.Errorf("%w: unknown direction %q for field %q", ErrInvalidOrderBy, parts[1], field.field)
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	// Always break ties on id, so the ordering is total and can be resumed
+	// from any race when paginating.
+	if !seen["id"] {
+		fields = append(fields, orderField{field: "id"})
+	}
+
+	return fields, nil
+}
+
+// orderClause renders validated order fields as an ORDER BY clause.
+func orderClause(d *dialect, fields []orderField) string {
+	terms := make([]string, 0, len(fields))
+
+	for _, f := range fields {
+		term := raceOrderColumns[f.field].expr(d)
+		if f.desc {
+			term += " DESC"
+		}
+
+		terms = append(terms, term)
+	}
+
+	return " ORDER BY " + strings.Join(terms, ", ")
+}
+
+// orderString renders validated order fields back into a canonical order_by
+// expression.
+func orderString(fields []orderField) string {
+	terms := make([]string, 0, len(fields))
+
+	for _, f := range fields {
+		term := f.field
+		if f.desc {
+			term += " desc"
+		}
+
+		terms = append(terms, term)
+	}
+
+	return strings.Join(terms, ", ")
+}
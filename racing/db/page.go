@@ -0,0 +1,198 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+const (
+	// defaultPageSize is used when the caller doesn't specify a page size.
+	defaultPageSize = 100
+	// maxPageSize caps the page size callers may request.
+	maxPageSize = 1000
+)
+
+var (
+	// ErrInvalidPageSize is returned when a negative page size is requested.
+	ErrInvalidPageSize = errors.New("invalid page_size")
+
+	// ErrInvalidPageToken is returned when a page token can't be decoded, or
+	// was issued for a different filter or ordering.
+	ErrInvalidPageToken = errors.New("invalid page_token")
+)
+
+// pageToken is the decoded form of the opaque page tokens handed to callers.
+// It records the sort key of the last race returned, which the next page
+// resumes after, and a hash of the query it was issued for.
+type pageToken struct {
+	// Keys holds the last race's value for each order field, in order.
+	Keys []interface{} `json:"k"`
+	// Query is the hash of the filter and ordering the token belongs to.
+	Query string `json:"q"`
+}
+
+// pageSize resolves the effective page size for a request.
+func pageSize(size int32) (int, error) {
+	switch {
+	case size < 0:
+		return 0, fmt.Errorf("%w: must not be negative", ErrInvalidPageSize)
+	case size == 0:
+		return defaultPageSize, nil
+	case size > maxPageSize:
+		return maxPageSize, nil
+	default:
+		return int(size), nil
+	}
+}
+
+// queryHash fingerprints the filter and ordering of a list request, so a page
+// token can't be replayed against a different query. Filters selecting the
+// same races, such as those listing meetings in different orders, share
+// their tokens.
+func queryHash(filter *racing.ListRacesRequestFilter, order []orderField) (string, error) {
+	filterBytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(normalizeFilter(filter))
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(filterBytes)
+	h.Write([]byte{0})
+	h.Write([]byte(orderString(order)))
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// normalizeFilter returns a copy of the filter with its meetings and
+// statuses sorted and deduplicated, so filters selecting the same races are
+// equal.
+func normalizeFilter(filter *racing.ListRacesRequestFilter) *racing.ListRacesRequestFilter {
+	normalized := &racing.ListRacesRequestFilter{}
+	if filter == nil {
+		return normalized
+	}
+
+	normalized.Visible = filter.Visible
+
+	meetings := make(map[int64]bool, len(filter.MeetingIds))
+	for _, id := range filter.MeetingIds {
+		if !meetings[id] {
+			meetings[id] = true
+			normalized.MeetingIds = append(normalized.MeetingIds, id)
+		}
+	}
+	sort.Slice(normalized.MeetingIds, func(i, j int) bool { return normalized.MeetingIds[i] < normalized.MeetingIds[j] })
+
+	statuses := make(map[racing.Race_Status]bool, len(filter.Statuses))
+	for _, status := range filter.Statuses {
+		if !statuses[status] {
+			statuses[status] = true
+			normalized.Statuses = append(normalized.Statuses, status)
+		}
+	}
+	sort.Slice(normalized.Statuses, func(i, j int) bool { return normalized.Statuses[i] < normalized.Statuses[j] })
+
+	return normalized
+}
+
+// encodePageToken builds the token for the page following the given race.
+func encodePageToken(last *racing.Race, order []orderField, hash string) (string, error) {
+	token := pageToken{Query: hash}
+
+	for _, f := range order {
+		token.Keys = append(token.Keys, raceOrderColumns[f.field].key(last))
+	}
+
+	b, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodePageToken decodes and validates a token against the query it's being
+// used with.
+func decodePageToken(s string, order []orderField, hash string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidPageToken)
+	}
+
+	var token pageToken
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	if err := dec.Decode(&token); err != nil {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidPageToken)
+	}
+
+	if token.Query != hash {
+		return nil, fmt.Errorf("%w: filter or order_by differs from the original request", ErrInvalidPageToken)
+	}
+
+	if len(token.Keys) != len(order) {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidPageToken)
+	}
+
+	for i, key := range token.Keys {
+		switch v := key.(type) {
+		case json.Number:
+			n, err := v.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("%w: malformed token", ErrInvalidPageToken)
+			}
+
+			token.Keys[i] = n
+		case string, bool:
+		default:
+			return nil, fmt.Errorf("%w: malformed token", ErrInvalidPageToken)
+		}
+	}
+
+	return &token, nil
+}
+
+// keysetClause builds a clause matching races sorted strictly after the given
+// keys, e.g. for "a desc, id" that is (a < ?) OR (a = ? AND id > ?).
+func keysetClause(d *dialect, order []orderField, keys []interface{}) (string, []interface{}) {
+	var (
+		terms []string
+		args  []interface{}
+	)
+
+	for i, f := range order {
+		var conds []string
+
+		for j := 0; j < i; j++ {
+			col := raceOrderColumns[order[j].field]
+			conds = append(conds, col.expr(d)+" = "+col.param(d))
+			args = append(args, keys[j])
+		}
+
+		op := " > "
+		if f.desc {
+			op = " < "
+		}
+
+		col := raceOrderColumns[f.field]
+		conds = append(conds, col.expr(d)+op+col.param(d))
+		args = append(args, keys[i])
+
+		terms = append(terms, "("+strings.Join(conds, " AND ")+")")
+	}
+
+	return "(" + strings.Join(terms, " OR ") + ")", args
+}
@@ -0,0 +1,72 @@
+package db_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+)
+
+// postgresDSNEnv names the environment variable holding the DSN of the
+// PostgreSQL database the Postgres repository is tested against, such as the
+// one in docker-compose.yml. The tests are skipped when it's unset.
+const postgresDSNEnv = "RACING_TEST_POSTGRES_DSN"
+
+// schemas counts the schemas created in the test database, so each test
+// gets its own.
+var schemas int64
+
+// openPostgres opens the test database within an empty schema of its own,
+// dropped when the test ends.
+func openPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+
+	racingDB, err := sql.Open(db.DriverPostgres, os.Getenv(postgresDSNEnv))
+	if err != nil {
+		t.Fatalf("opening %s: %v", postgresDSNEnv, err)
+	}
+
+	// The search path is set on a single connection, so it's kept open
+	// throughout rather than replaced.
+	racingDB.SetMaxOpenConns(1)
+	racingDB.SetMaxIdleConns(1)
+
+	schema := fmt.Sprintf("races_test_%d_%d", os.Getpid(), atomic.AddInt64(&schemas, 1))
+
+	for _, statement := range []string{
+		"DROP SCHEMA IF EXISTS " + schema + " CASCADE",
+		"CREATE SCHEMA " + schema,
+		"SET search_path TO " + schema,
+	} {
+		if _, err := racingDB.Exec(statement); err != nil {
+			racingDB.Close()
+			t.Fatalf("preparing schema %s: %v", schema, err)
+		}
+	}
+
+	t.Cleanup(func() {
+		if _, err := racingDB.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+
+		racingDB.Close()
+	})
+
+	return racingDB
+}
+
+func TestPostgresRacesRepo(t *testing.T) {
+	if os.Getenv(postgresDSNEnv) == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	dbtest.RunRacesRepoSuite(t, func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo {
+		return db.NewPostgresRacesRepo(openPostgres(t), opts...)
+	})
+}
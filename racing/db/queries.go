@@ -1,7 +1,12 @@
 package db
 
 const (
-	racesList = "list"
+	racesList      = "list"
+	racesInsert    = "insert"
+	racesUpdate    = "update"
+	racesDelete    = "delete"
+	racesDuplicate = "duplicate"
+	racesSeed      = "seed"
 )
 
 func getRaceQueries() map[string]string {
@@ -13,8 +18,37 @@ func getRaceQueries() map[string]string {
 				name, 
 				number, 
 				visible, 
-				advertised_start_time 
+				advertised_start_time, 
+				version, 
+				last_modified 
 			FROM races
 		`,
+		racesInsert: `
+			INSERT INTO races(meeting_id, name, number, visible, advertised_start_time, version, last_modified) 
+			VALUES (?,?,?,?,?,1,?)
+		`,
+		racesUpdate: `
+			UPDATE races 
+			SET 
+				meeting_id = ?, 
+				name = ?, 
+				number = ?, 
+				visible = ?, 
+				advertised_start_time = ?, 
+				version = version + 1, 
+				last_modified = ? 
+			WHERE id = ?
+		`,
+		racesDelete: `
+			DELETE FROM races WHERE id = ?
+		`,
+		racesDuplicate: `
+			SELECT id FROM races WHERE meeting_id = ? AND number = ? AND id != ? LIMIT 1
+		`,
+		racesSeed: `
+			INSERT INTO races(id, meeting_id, name, number, visible, advertised_start_time, version, last_modified) 
+			VALUES (?,?,?,?,?,?,1,?) 
+			ON CONFLICT DO NOTHING
+		`,
 	}
 }
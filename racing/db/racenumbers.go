@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// duplicateRaceNumbersQuery selects the races sharing their meeting and
+// number with another, in the order they're renumbered.
+const duplicateRaceNumbersQuery = `
+	SELECT id, meeting_id, number FROM races
+	WHERE (meeting_id, number) IN (SELECT meeting_id, number FROM races GROUP BY meeting_id, number HAVING COUNT(*) > 1)
+	ORDER BY meeting_id, number, id
+`
+
+// DuplicateRaceNumber is a meeting and number held by several races.
+type DuplicateRaceNumber struct {
+	MeetingID int64
+	Number    int64
+	// RaceIDs holds the races sharing the number, in ID order.
+	RaceIDs []int64
+}
+
+// DuplicateRaceNumbersError refuses migrating to unique race numbers while
+// races share them.
+type DuplicateRaceNumbersError struct {
+	Duplicates []DuplicateRaceNumber
+}
+
+func (e *DuplicateRaceNumbersError) Error() string {
+	pairs := make([]string, len(e.Duplicates))
+
+	for i, d := range e.Duplicates {
+		ids := make([]string, len(d.RaceIDs))
+		for j, id := range d.RaceIDs {
+			ids[j] = fmt.Sprint(id)
+		}
+
+		pairs[i] = fmt.Sprintf("meeting %d number %d (races %s)", d.MeetingID, d.Number, strings.Join(ids, ", "))
+	}
+
+	return fmt.Sprintf("races share meeting and number, which must be unique: %s", strings.Join(pairs, "; "))
+}
+
+// RenumberedRace is a race given a new number by RenumberDuplicateRaces.
+type RenumberedRace struct {
+	ID        int64
+	MeetingID int64
+	From, To  int64
+}
+
+// checkRaceNumbers refuses creating the unique index of race numbers while
+// races share them, returning a DuplicateRaceNumbersError listing them.
+func checkRaceNumbers(ctx context.Context, tx *sql.Tx, d *dialect) error {
+	var dupErr DuplicateRaceNumbersError
+
+	err := scanDuplicateRaceNumbers(ctx, tx, func(id, meetingID, number int64) {
+		n := len(dupErr.Duplicates)
+		if n == 0 || dupErr.Duplicates[n-1].MeetingID != meetingID || dupErr.Duplicates[n-1].Number != number {
+			dupErr.Duplicates = append(dupErr.Duplicates, DuplicateRaceNumber{MeetingID: meetingID, Number: number})
+			n++
+		}
+
+		dupErr.Duplicates[n-1].RaceIDs = append(dupErr.Duplicates[n-1].RaceIDs, id)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(dupErr.Duplicates) > 0 {
+		return &dupErr
+	}
+
+	return nil
+}
+
+// RenumberDuplicateRaces leaves the first race, by ID, of each meeting and
+// number held by several with that number, and gives the rest the next
+// numbers unused by their meeting, so races can be migrated to unique
+// numbers. No races are deleted. It returns the races renumbered.
+func (m *Migrator) RenumberDuplicateRaces(ctx context.Context) ([]RenumberedRace, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		renumbered []RenumberedRace
+		// kept holds the race keeping each meeting and number.
+		kept = make(map[[2]int64]bool)
+	)
+
+	err = scanDuplicateRaceNumbers(ctx, tx, func(id, meetingID, number int64) {
+		if key := [2]int64{meetingID, number}; !kept[key] {
+			kept[key] = true
+			return
+		}
+
+		renumbered = append(renumbered, RenumberedRace{ID: id, MeetingID: meetingID, From: number})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The next number unused by each meeting.
+	next := make(map[int64]int64)
+
+	for i, race := range renumbered {
+		if _, ok := next[race.MeetingID]; !ok {
+			var highest int64
+			if err := tx.QueryRowContext(ctx, m.dialect.rebind(`SELECT MAX(number) FROM races WHERE meeting_id = ?`), race.MeetingID).Scan(&highest); err != nil {
+				return nil, err
+			}
+
+			next[race.MeetingID] = highest + 1
+		}
+
+		renumbered[i].To = next[race.MeetingID]
+		next[race.MeetingID]++
+
+		if _, err := tx.ExecContext(ctx, m.dialect.rebind(`UPDATE races SET number = ? WHERE id = ?`), renumbered[i].To, race.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return renumbered, nil
+}
+
+// scanDuplicateRaceNumbers calls fn with each race sharing its meeting and
+// number with another, ordered by meeting, number and ID.
+func scanDuplicateRaceNumbers(ctx context.Context, tx *sql.Tx, fn func(id, meetingID, number int64)) error {
+	rows, err := tx.QueryContext(ctx, duplicateRaceNumbersQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, meetingID, number int64
+		if err := rows.Scan(&id, &meetingID, &number); err != nil {
+			return err
+		}
+
+		fn(id, meetingID, number)
+	}
+
+	return rows.Err()
+}
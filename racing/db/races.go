@@ -1,13 +1,18 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"git.neds.sh/matty/entain/racing/proto/racing"
 )
@@ -15,61 +20,445 @@ import (
 // RacesRepo provides repository access to races.
 type RacesRepo interface {
 	// Init will initialise our races repository.
-	Init() error
+	Init(ctx context.Context) error
 
-	// List will return a list of races.
-	List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error)
+	// List will return a page of races matching the request's filter, sorted
+	// by its AIP-132 order_by expression, along with the token for the next
+	// page. The token is empty once there are no more races.
+	List(ctx context.Context, in *racing.ListRacesRequest) ([]*racing.Race, string, error)
+
+	// Get will return the race with the given ID, or ErrNotFound.
+	Get(ctx context.Context, id int64) (*racing.Race, error)
+
+	// Create will store a new race, returning it with its assigned ID.
+	Create(ctx context.Context, race *racing.Race) (*racing.Race, error)
+
+	// Update will overwrite the given fields of an existing race, or all
+	// updatable fields when none are given, returning the updated race.
+	Update(ctx context.Context, race *racing.Race, fields []string) (*racing.Race, error)
+
+	// Delete will remove the race with the given ID.
+	Delete(ctx context.Context, id int64) error
+}
+
+var (
+	// ErrNotFound is returned when a requested race doesn't exist.
+	ErrNotFound = errors.New("race not found")
+
+	// ErrAlreadyExists is returned when a write would leave two races with
+	// the same meeting and number.
+	ErrAlreadyExists = errors.New("race already exists")
+
+	// ErrInvalidUpdateMask is returned when an update names a field that
+	// doesn't exist or can't be updated.
+	ErrInvalidUpdateMask = errors.New("invalid update_mask")
+)
+
+// updatableFields lists the race fields that may be written by callers.
+var updatableFields = []string{
+	"meeting_id",
+	"name",
+	"number",
+	"visible",
+	"advertised_start_time",
 }
 
 type racesRepo struct {
-	db   *sql.DB
-	init sync.Once
+	repoOptions
+
+	db      *sql.DB
+	dialect *dialect
+	init    sync.Once
+}
+
+// repoOptions holds the optional behaviour shared by races repositories.
+type repoOptions struct {
+	clock         func() time.Time
+	seeder        Seeder
+	queryDuration *prometheus.HistogramVec
+	cacheLookups  *prometheus.CounterVec
+}
+
+// RacesRepoOption configures optional behaviour of a races repository.
+type RacesRepoOption func(*repoOptions)
+
+// WithClock overrides the clock used to derive race statuses, and to stamp
+// races with the time they were last modified, which defaults to time.Now.
+func WithClock(clock func() time.Time) RacesRepoOption {
+	return func(o *repoOptions) {
+		o.clock = clock
+	}
+}
+
+// WithSeeder seeds the repository with the seeder's races when initialised.
+// By default, no races are seeded.
+func WithSeeder(seeder Seeder) RacesRepoOption {
+	return func(o *repoOptions) {
+		o.seeder = seeder
+	}
+}
+
+// newRepoOptions applies options over the defaults.
+func newRepoOptions(opts []RacesRepoOption) repoOptions {
+	o := repoOptions{clock: time.Now}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// NewRacesRepo creates a new races repository, stored in SQLite.
+func NewRacesRepo(db *sql.DB, opts ...RacesRepoOption) RacesRepo {
+	return newRacesRepo(db, sqliteDialect, opts...)
 }
 
-// NewRacesRepo creates a new races repository.
-func NewRacesRepo(db *sql.DB) RacesRepo {
-	return &racesRepo{db: db}
+// NewPostgresRacesRepo creates a new races repository, stored in PostgreSQL.
+func NewPostgresRacesRepo(db *sql.DB, opts ...RacesRepoOption) RacesRepo {
+	return newRacesRepo(db, postgresDialect, opts...)
 }
 
-// Init prepares the race repository dummy data.
-func (r *racesRepo) Init() error {
+func newRacesRepo(db *sql.DB, d *dialect, opts ...RacesRepoOption) RacesRepo {
+	return &racesRepo{repoOptions: newRepoOptions(opts), db: db, dialect: d}
+}
+
+// Init migrates the race repository's schema, and seeds it if configured to.
+func (r *racesRepo) Init(ctx context.Context) error {
 	var err error
 
 	r.init.Do(func() {
-		// For test/example purposes, we seed the DB with some dummy races.
-		err = r.seed()
+		defer r.observe("init", time.Now())
+
+		var migrator *Migrator
+
+		migrator, err = newMigrator(r.db, r.dialect)
+		if err != nil {
+			return
+		}
+
+		if err = migrator.Up(ctx); err != nil {
+			return
+		}
+
+		err = r.seed(ctx)
 	})
 
 	return err
 }
 
-func (r *racesRepo) List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error) {
+func (r *racesRepo) List(ctx context.Context, in *racing.ListRacesRequest) ([]*racing.Race, string, error) {
+	defer r.observe("list", time.Now())
+
 	var (
 		err   error
 		query string
 		args  []interface{}
 	)
 
+	order, err := parseOrderBy(in.OrderBy)
+	if err != nil {
+		return nil, "", err
+	}
+
+	size, err := pageSize(in.PageSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := queryHash(in.Filter, order)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Take a single reading of the clock so filtering and status derivation
+	// agree with each other.
+	now := r.clock()
+
+	clauses, args := r.applyFilter(in.Filter, now)
+
+	if in.PageToken != "" {
+		token, err := decodePageToken(in.PageToken, order, hash)
+		if err != nil {
+			return nil, "", err
+		}
+
+		clause, keyArgs := keysetClause(r.dialect, order, token.Keys)
+		clauses = append(clauses, clause)
+		args = append(args, keyArgs...)
+	}
+
 	query = getRaceQueries()[racesList]
 
-	query, args = r.applyFilter(query, filter)
+	if len(clauses) != 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	// Fetch one race beyond the page, to tell whether another page follows.
+	query += orderClause(r.dialect, order) + " LIMIT ?"
+	args = append(args, size+1)
+
+	query = r.dialect.rebind(query)
+
+	ctx, span := r.startQuerySpan(ctx, "racesRepo.List", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		recordError(span, err)
+		return nil, "", err
+	}
+
+	races, err := r.scanRaces(rows, now)
+	if err != nil {
+		recordError(span, err)
+		return nil, "", err
+	}
+
+	span.SetAttributes(attribute.Int("db.rows", len(races)))
+
+	if len(races) <= size {
+		return races, "", nil
+	}
+
+	races = races[:size]
+
+	next, err := encodePageToken(races[size-1], order, hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return races, next, nil
+}
+
+func (r *racesRepo) Get(ctx context.Context, id int64) (*racing.Race, error) {
+	defer r.observe("get", time.Now())
+
+	now := r.clock()
+
+	query := getRaceQueries()[racesList] + " WHERE id = ?"
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), id)
+	if err != nil {
+		return nil, err
+	}
+
+	races, err := r.scanRaces(rows, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(races) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return races[0], nil
+}
+
+func (r *racesRepo) Create(ctx context.Context, race *racing.Race) (*racing.Race, error) {
+	defer r.observe("create", time.Now())
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := r.checkDuplicate(ctx, tx, race); err != nil {
+		return nil, err
+	}
+
+	id, err := r.insert(ctx, tx, race)
+	if err != nil {
+		return nil, r.uniqueError(err, race)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.Get(ctx, id)
+}
+
+func (r *racesRepo) Update(ctx context.Context, race *racing.Race, fields []string) (*racing.Race, error) {
+	defer r.observe("update", time.Now())
+
+	if len(fields) == 0 {
+		fields = updatableFields
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, r.dialect.rebind(getRaceQueries()[racesList]+" WHERE id = ?"), race.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := r.db.Query(query, args...)
+	existing, err := r.scanRaces(rows, r.clock())
 	if err != nil {
 		return nil, err
 	}
 
-	return r.scanRaces(rows)
+	if len(existing) == 0 {
+		return nil, ErrNotFound
+	}
+
+	updated := existing[0]
+	if err := applyFields(updated, race, fields); err != nil {
+		return nil, err
+	}
+
+	if err := r.checkDuplicate(ctx, tx, updated); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		r.dialect.rebind(getRaceQueries()[racesUpdate]),
+		updated.MeetingId,
+		updated.Name,
+		updated.Number,
+		updated.Visible,
+		formatTime(updated.AdvertisedStartTime),
+		r.modifiedTime(),
+		updated.Id,
+	); err != nil {
+		return nil, r.uniqueError(err, updated)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.Get(ctx, race.Id)
+}
+
+func (r *racesRepo) Delete(ctx context.Context, id int64) error {
+	defer r.observe("delete", time.Now())
+
+	res, err := r.db.ExecContext(ctx, r.dialect.rebind(getRaceQueries()[racesDelete]), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// insert stores a race, without an ID, returning the ID it's assigned.
+func (r *racesRepo) insert(ctx context.Context, tx *sql.Tx, race *racing.Race) (int64, error) {
+	query := r.dialect.rebind(getRaceQueries()[racesInsert])
+	args := []interface{}{
+		race.MeetingId,
+		race.Name,
+		race.Number,
+		race.Visible,
+		formatTime(race.AdvertisedStartTime),
+		r.modifiedTime(),
+	}
+
+	if r.dialect.returningID {
+		var id int64
+		err := tx.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+
+		return id, err
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// checkDuplicate ensures no other race shares the race's meeting and number.
+func (r *racesRepo) checkDuplicate(ctx context.Context, tx *sql.Tx, race *racing.Race) error {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, r.dialect.rebind(getRaceQueries()[racesDuplicate]), race.MeetingId, race.Number, race.Id).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	default:
+		return duplicateError(id, race)
+	}
+}
+
+// uniqueError returns ErrAlreadyExists in place of the database refusing to
+// write a race as another already has its meeting and number, as it does when
+// the race is written concurrently with checkDuplicate.
+func (r *racesRepo) uniqueError(err error, race *racing.Race) error {
+	if !r.dialect.uniqueViolation(err) {
+		return err
+	}
+
+	return fmt.Errorf("%w: number %d of meeting %d is already taken", ErrAlreadyExists, race.Number, race.MeetingId)
+}
+
+// duplicateError reports that the race with the given ID already has the
+// race's meeting and number.
+func duplicateError(id int64, race *racing.Race) error {
+	return fmt.Errorf("%w: race %d is already number %d of meeting %d", ErrAlreadyExists, id, race.Number, race.MeetingId)
+}
+
+// applyFields copies the named fields from src onto dst.
+func applyFields(dst, src *racing.Race, fields []string) error {
+	for _, field := range fields {
+		switch field {
+		case "meeting_id":
+			dst.MeetingId = src.MeetingId
+		case "name":
+			dst.Name = src.Name
+		case "number":
+			dst.Number = src.Number
+		case "visible":
+			dst.Visible = src.Visible
+		case "advertised_start_time":
+			dst.AdvertisedStartTime = src.AdvertisedStartTime
+		default:
+			return fmt.Errorf("%w: field %q can't be updated", ErrInvalidUpdateMask, field)
+		}
+	}
+
+	return nil
+}
+
+// formatTime formats a timestamp the way advertised start times are stored.
+func formatTime(ts *timestamppb.Timestamp) string {
+	return ts.AsTime().Format(time.RFC3339)
+}
+
+// modifiedTime formats the current time the way races' last modified times
+// are stored.
+func (r *racesRepo) modifiedTime() string {
+	return r.clock().UTC().Format(time.RFC3339)
 }
 
-func (r *racesRepo) applyFilter(query string, filter *racing.ListRacesRequestFilter) (string, []interface{}) {
+// applyFilter builds the WHERE clauses, and their arguments, selecting races
+// that match the filter.
+func (r *racesRepo) applyFilter(filter *racing.ListRacesRequestFilter, now time.Time) ([]string, []interface{}) {
 	var (
 		clauses []string
 		args    []interface{}
 	)
 
 	if filter == nil {
-		return query, args
+		return clauses, args
 	}
 
 	if len(filter.MeetingIds) > 0 {
@@ -80,23 +469,76 @@ func (r *racesRepo) applyFilter(query string, filter *racing.ListRacesRequestFil
 		}
 	}
 
-	if len(clauses) != 0 {
-		query += " WHERE " + strings.Join(clauses, " AND ")
+	if filter.Visible != nil {
+		clauses = append(clauses, "visible = ?")
+		args = append(args, filter.GetVisible())
+	}
+
+	if statusClause, statusArgs := r.statusFilter(filter.Statuses, now); statusClause != "" {
+		clauses = append(clauses, statusClause)
+		args = append(args, statusArgs...)
+	}
+
+	return clauses, args
+}
+
+// statusFilter builds a clause matching races in any of the given statuses,
+// relative to now. An empty clause means no restriction is required.
+func (r *racesRepo) statusFilter(statuses []racing.Race_Status, now time.Time) (string, []interface{}) {
+	var (
+		clauses []string
+		args    []interface{}
+		seen    = make(map[racing.Race_Status]bool)
+		start   = r.dialect.datetime("advertised_start_time")
+		param   = r.dialect.datetime("?")
+	)
+
+	for _, status := range statuses {
+		if seen[status] {
+			continue
+		}
+		seen[status] = true
+
+		switch status {
+		case racing.Race_OPEN:
+			clauses = append(clauses, start+" > "+param)
+			args = append(args, now.Format(time.RFC3339))
+		case racing.Race_CLOSED:
+			clauses = append(clauses, start+" <= "+param)
+			args = append(args, now.Format(time.RFC3339))
+		}
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// raceStatus derives the status of a race advertised to start at the given
+// time, relative to now.
+func raceStatus(advertisedStart, now time.Time) racing.Race_Status {
+	if advertisedStart.After(now) {
+		return racing.Race_OPEN
 	}
 
-	return query, args
+	return racing.Race_CLOSED
 }
 
 func (m *racesRepo) scanRaces(
 	rows *sql.Rows,
+	now time.Time,
 ) ([]*racing.Race, error) {
+	defer rows.Close()
+
 	var races []*racing.Race
 
 	for rows.Next() {
 		var race racing.Race
-		var advertisedStart time.Time
+		var advertisedStart, lastModified time.Time
 
-		if err := rows.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart); err != nil {
+		if err := rows.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart, &race.Version, &lastModified); err != nil {
 			if err == sql.ErrNoRows {
 				return nil, nil
 			}
@@ -110,9 +552,11 @@ func (m *racesRepo) scanRaces(
 		}
 
 		race.AdvertisedStartTime = ts
+		race.Status = raceStatus(advertisedStart, now)
+		race.LastModified = timestamppb.New(lastModified)
 
 		races = append(races, &race)
 	}
 
-	return races, nil
+	return races, rows.Err()
 }
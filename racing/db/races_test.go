@@ -0,0 +1,159 @@
+// The SQLite driver needs cgo, so these tests are skipped without it.
+
+//go:build cgo
+// +build cgo
+
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+)
+
+// databases counts the in-memory SQLite databases opened, so each test gets
+// its own.
+var databases int64
+
+// openSQLite opens an empty in-memory SQLite database, closed when the test
+// ends.
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:races%d?mode=memory&cache=shared", atomic.AddInt64(&databases, 1))
+
+	racingDB, err := sql.Open(db.DriverSQLite, dsn)
+	if err != nil {
+		t.Fatalf("opening %s: %v", dsn, err)
+	}
+
+	// The database lives only as long as a connection to it, so a single
+	// connection is kept open throughout.
+	racingDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { racingDB.Close() })
+
+	return racingDB
+}
+
+func TestSQLiteRacesRepo(t *testing.T) {
+	dbtest.RunRacesRepoSuite(t, func(t *testing.T, opts ...db.RacesRepoOption) db.RacesRepo {
+		return db.NewRacesRepo(openSQLite(t), opts...)
+	})
+}
+
+func TestSQLiteMigrationRefusesDuplicateRaceNumbers(t *testing.T) {
+	ctx := context.Background()
+	racingDB := openSQLite(t)
+
+	migrator, err := db.NewMigrator(racingDB, db.DriverSQLite)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	// Back to before races were numbered uniquely, when duplicates could be
+	// stored.
+	if err := migrator.Down(ctx, 1); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	if _, err := racingDB.ExecContext(ctx, `
+		INSERT INTO races(id, meeting_id, name, number, visible, advertised_start_time)
+		VALUES (1, 1, 'Alpha', 1, 1, '2021-03-02T12:00:00Z'), (2, 1, 'Bravo', 1, 1, '2021-03-02T12:00:00Z'), (3, 1, 'Charlie', 2, 1, '2021-03-02T12:00:00Z'),
+			(4, 1, 'Delta', 1, 1, '2021-03-02T12:00:00Z'), (5, 2, 'Echo', 1, 1, '2021-03-02T12:00:00Z'), (6, 2, 'Foxtrot', 1, 1, '2021-03-02T12:00:00Z')
+	`); err != nil {
+		t.Fatalf("inserting races: %v", err)
+	}
+
+	var dupErr *db.DuplicateRaceNumbersError
+	if err := migrator.Up(ctx); !errors.As(err, &dupErr) {
+		t.Fatalf("Up = %v, want a DuplicateRaceNumbersError", err)
+	}
+
+	wantDuplicates := []db.DuplicateRaceNumber{
+		{MeetingID: 1, Number: 1, RaceIDs: []int64{1, 2, 4}},
+		{MeetingID: 2, Number: 1, RaceIDs: []int64{5, 6}},
+	}
+	if !reflect.DeepEqual(dupErr.Duplicates, wantDuplicates) {
+		t.Errorf("duplicates = %+v, want %+v", dupErr.Duplicates, wantDuplicates)
+	}
+
+	// Nothing was deleted, nor the migration recorded.
+	if numbers := raceNumbers(t, racingDB); len(numbers) != 6 {
+		t.Errorf("races after refused migration = %v, want all 6", numbers)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if last := statuses[len(statuses)-1]; last.AppliedAt != nil {
+		t.Errorf("migration %d_%s applied, want it pending", last.Version, last.Name)
+	}
+
+	renumbered, err := migrator.RenumberDuplicateRaces(ctx)
+	if err != nil {
+		t.Fatalf("RenumberDuplicateRaces: %v", err)
+	}
+
+	wantRenumbered := []db.RenumberedRace{
+		{ID: 2, MeetingID: 1, From: 1, To: 3},
+		{ID: 4, MeetingID: 1, From: 1, To: 4},
+		{ID: 6, MeetingID: 2, From: 1, To: 2},
+	}
+	if !reflect.DeepEqual(renumbered, wantRenumbered) {
+		t.Errorf("RenumberDuplicateRaces = %+v, want %+v", renumbered, wantRenumbered)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up after renumbering: %v", err)
+	}
+
+	wantNumbers := map[int64]int64{1: 1, 2: 3, 3: 2, 4: 4, 5: 1, 6: 2}
+	if numbers := raceNumbers(t, racingDB); !reflect.DeepEqual(numbers, wantNumbers) {
+		t.Errorf("race numbers after migrating = %v, want %v", numbers, wantNumbers)
+	}
+
+	if _, err := racingDB.ExecContext(ctx, `INSERT INTO races(id, meeting_id, name, number, visible, advertised_start_time) VALUES (7, 1, 'Golf', 2, 1, '2021-03-02T12:00:00Z')`); err == nil {
+		t.Error("inserting a duplicate race number succeeded, want it refused")
+	}
+}
+
+// raceNumbers returns the number of every race, by ID.
+func raceNumbers(t *testing.T, racingDB *sql.DB) map[int64]int64 {
+	t.Helper()
+
+	rows, err := racingDB.Query(`SELECT id, number FROM races`)
+	if err != nil {
+		t.Fatalf("listing races: %v", err)
+	}
+	defer rows.Close()
+
+	numbers := make(map[int64]int64)
+
+	for rows.Next() {
+		var id, number int64
+		if err := rows.Scan(&id, &number); err != nil {
+			t.Fatalf("scanning race: %v", err)
+		}
+		numbers[id] = number
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatalf("listing races: %v", err)
+	}
+
+	return numbers
+}
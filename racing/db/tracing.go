@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the repository's queries, through the global
+// tracer provider.
+var tracer = otel.Tracer("git.neds.sh/matty/entain/racing/db")
+
+// startQuerySpan starts the span of a query against the database.
+func (r *racesRepo) startQuerySpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			r.dialect.system,
+			semconv.DBStatementKey.String(query),
+		),
+	)
+}
+
+// recordError marks a span as failed by err.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// setServingStatus reports the serving status of both the server as a whole
+// and the racing service.
+func setServingStatus(healthServer *health.Server, status healthpb.HealthCheckResponse_ServingStatus) {
+	healthServer.SetServingStatus("", status)
+	healthServer.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, status)
+}
+
+// monitorHealth reports the service as serving only while its database can be
+// reached, pinging it on the given interval until ctx is done. The in-memory
+// repository has no database, and is always reachable.
+func monitorHealth(ctx context.Context, healthServer *health.Server, racingDB *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	serving := true
+
+	for {
+		err := pingDB(ctx, racingDB, interval)
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil && serving:
+			log.Warnf("database unreachable, reporting not serving: %s", err)
+			setServingStatus(healthServer, healthpb.HealthCheckResponse_NOT_SERVING)
+		case err == nil && !serving:
+			log.Info("database reachable again, reporting serving")
+			setServingStatus(healthServer, healthpb.HealthCheckResponse_SERVING)
+		}
+
+		serving = err == nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pingDB checks the database can be reached within the timeout.
+func pingDB(ctx context.Context, racingDB *sql.DB, timeout time.Duration) error {
+	if racingDB == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return racingDB.PingContext(ctx)
+}
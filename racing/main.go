@@ -1,59 +1,347 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"time"
 
+	"git.neds.sh/matty/entain/racing/auth"
+	"git.neds.sh/matty/entain/racing/certs"
+	"git.neds.sh/matty/entain/racing/config"
 	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/middleware"
 	"git.neds.sh/matty/entain/racing/proto/racing"
 	"git.neds.sh/matty/entain/racing/service"
+	"git.neds.sh/matty/entain/shared/lifecycle"
+	"git.neds.sh/matty/entain/shared/tracing"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
-)
-
-var (
-	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	flag.Parse()
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed loading config: %s", err)
+	}
+
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	log.SetLevel(level)
 
-	if err := run(); err != nil {
-		log.Fatalf("failed running grpc server: %s\n", err)
+	if cfg.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := migrate(cfg, args[1:]); err != nil {
+			log.Fatalf("failed running migrations: %s", err)
+		}
+
+		return
+	}
+
+	if err := run(cfg); err != nil {
+		log.Fatalf("failed running grpc server: %s", err)
 	}
 }
 
-func run() error {
-	conn, err := net.Listen("tcp", ":9000")
+func run(cfg *config.Config) (err error) {
+	ctx, stop := lifecycle.ShutdownContext(context.Background())
+	defer stop()
+
+	conn, err := net.Listen("tcp", cfg.GRPCEndpoint)
 	if err != nil {
 		return err
 	}
 
-	racingDB, err := sql.Open("sqlite3", "./db/racing.db")
+	shutdownTracing, err := tracing.Init(ctx, tracing.Config(cfg.Tracing), "racing")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	racesRepo := db.NewRacesRepo(racingDB)
-	if err := racesRepo.Init(); err != nil {
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("failed flushing trace spans: %s", err)
+		}
+	}()
+
+	if cfg.AdminEndpoint != "" {
+		adminServer, err := lifecycle.ServeAdmin(cfg.AdminEndpoint, promhttp.Handler())
+		if err != nil {
+			return err
+		}
+		defer adminServer.Close()
+	}
+
+	policy, err := auth.LoadPolicy(cfg.PolicyFile)
+	if err != nil {
 		return err
 	}
 
-	grpcServer := grpc.NewServer()
+	// Principals are only trusted from verified client certificates.
+	if cfg.TLS.ClientCAFile == "" {
+		log.Warn("tls.client_ca_file is unset, so every caller is anonymous and the policy grants no permissions")
+	}
+
+	seeder, err := newSeeder(cfg.Seed)
+	if err != nil {
+		return err
+	}
+
+	racesRepo, racingDB, err := newRacesRepo(cfg.DB, db.WithSeeder(seeder), db.WithMetrics(prometheus.DefaultRegisterer))
+	if err != nil {
+		return err
+	}
+	if racingDB != nil {
+		defer func() {
+			if closeErr := racingDB.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	if cfg.Cache.Size > 0 {
+		racesRepo = db.NewCachingRacesRepo(racesRepo, cfg.Cache.Size, cfg.Cache.TTL, db.WithMetrics(prometheus.DefaultRegisterer))
+	}
+
+	metrics := middleware.NewServerMetrics(prometheus.DefaultRegisterer)
+
+	opts := []grpc.ServerOption{
+		// Tracing, metrics and logging come first, so they see the outcome of
+		// every other interceptor, such as a timeout. The caller's principal
+		// is read before them, so it's logged.
+		grpc.ChainUnaryInterceptor(
+			otelgrpc.UnaryServerInterceptor(),
+			middleware.UnaryPrincipal(),
+			metrics.Unary(),
+			middleware.UnaryLogging(),
+			middleware.UnaryTimeout(cfg.RPCTimeout),
+		),
+		// Watches would otherwise hold up draining until the shutdown
+		// timeout, so they're ended as soon as shutdown begins.
+		grpc.ChainStreamInterceptor(
+			otelgrpc.StreamServerInterceptor(),
+			middleware.StreamPrincipal(),
+			metrics.Stream(),
+			middleware.StreamLogging(),
+			middleware.StreamDrain(ctx),
+		),
+	}
+
+	creds, err := certs.ServerCredentials(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
 
 	racing.RegisterRacingServer(
 		grpcServer,
 		service.NewRacingService(
 			racesRepo,
+			policy,
 		),
 	)
 
-	log.Printf("gRPC server listening on: %s\n", *grpcEndpoint)
+	// The service reports not serving until its repository is initialised,
+	// so no traffic is routed to it while migrating and seeding.
+	healthServer := health.NewServer()
+	setServingStatus(healthServer, healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	log.Infof("gRPC server listening on: %s", cfg.GRPCEndpoint)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(conn)
+	}()
+
+	if err := racesRepo.Init(ctx); err != nil {
+		grpcServer.Stop()
+		return explainMigrationError(err)
+	}
+
+	setServingStatus(healthServer, healthpb.HealthCheckResponse_SERVING)
+	go monitorHealth(ctx, healthServer, racingDB, cfg.HealthCheckInterval)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Report not serving first, so traffic moves elsewhere while draining.
+	healthServer.Shutdown()
+
+	log.Infof("shutting down, draining connections for up to %s", cfg.ShutdownTimeout)
+
+	return drain(grpcServer, cfg.ShutdownTimeout)
+}
 
-	if err := grpcServer.Serve(conn); err != nil {
+// drain gracefully stops the server, waiting for in-flight RPCs to finish,
+// and forcibly stops it if they haven't within the timeout.
+func drain(grpcServer *grpc.Server, timeout time.Duration) error {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-timer.C:
+		grpcServer.Stop()
+		return fmt.Errorf("connections not drained within %s", timeout)
+	}
+}
+
+// newRacesRepo creates the races repository for the configured database,
+// along with the database it's stored in, which is nil for the in-memory
+// repository.
+func newRacesRepo(cfg config.DB, opts ...db.RacesRepoOption) (db.RacesRepo, *sql.DB, error) {
+	if cfg.Driver == db.DriverMemory {
+		return db.NewMemoryRacesRepo(opts...), nil, nil
+	}
+
+	racingDB, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.Driver {
+	case db.DriverSQLite:
+		return db.NewRacesRepo(racingDB, opts...), racingDB, nil
+	case db.DriverPostgres:
+		return db.NewPostgresRacesRepo(racingDB, opts...), racingDB, nil
+	default:
+		racingDB.Close()
+		return nil, nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+	}
+}
+
+// newSeeder returns the configured seeder, or nil when races shouldn't be
+// seeded.
+func newSeeder(cfg config.Seed) (db.Seeder, error) {
+	switch cfg.Mode {
+	case "none":
+		return nil, nil
+	case "demo":
+		reference := time.Now()
+
+		if cfg.Reference != "" {
+			t, err := time.Parse(time.RFC3339, cfg.Reference)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seed reference %q: %w", cfg.Reference, err)
+			}
+
+			reference = t
+		}
+
+		return db.DemoSeeder(cfg.Random, reference), nil
+	case "fixture":
+		return db.FixtureSeeder(cfg.Fixture), nil
+	default:
+		return nil, fmt.Errorf("unknown seed mode %q", cfg.Mode)
+	}
+}
+
+// migrate runs the migrate subcommand: "up", "down [steps]", "status" or
+// "renumber".
+func migrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: racing migrate up|down [steps]|status|renumber")
+	}
+
+	racingDB, err := sql.Open(cfg.DB.Driver, cfg.DB.DSN)
+	if err != nil {
 		return err
 	}
+	defer racingDB.Close()
+
+	migrator, err := db.NewMigrator(racingDB, cfg.DB.Driver)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return explainMigrationError(migrator.Up(ctx))
+	case "down":
+		steps := 1
+
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+
+		return migrator.Down(ctx, steps)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(os.Stdout, "%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+
+		return nil
+	case "renumber":
+		renumbered, err := migrator.RenumberDuplicateRaces(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, race := range renumbered {
+			fmt.Fprintf(os.Stdout, "race %d\tmeeting %d\tnumber %d -> %d\n", race.ID, race.MeetingID, race.From, race.To)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// explainMigrationError adds to a migration refused by races sharing their
+// meeting and number how to fix them.
+func explainMigrationError(err error) error {
+	var dupErr *db.DuplicateRaceNumbersError
+	if errors.As(err, &dupErr) {
+		return fmt.Errorf(`%w; fix or delete them, or run "racing migrate renumber" to give all but the first of each the next numbers free in their meeting`, err)
+	}
 
-	return nil
+	return err
 }
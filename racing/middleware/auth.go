@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+
+	"git.neds.sh/matty/entain/shared/principal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// UnaryPrincipal reads the principal the gateway forwarded with each unary
+// RPC into its context, for principal.FromContext. Principals are only read from
+// peers that presented a verified client certificate, as any other caller
+// could claim to be anyone; RPCs from those are anonymous.
+func UnaryPrincipal() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withPrincipal(ctx), req)
+	}
+}
+
+// StreamPrincipal reads the principal the gateway forwarded with each
+// streaming RPC into its context, for principal.FromContext. As with
+// UnaryPrincipal, only verified peers' principals are read.
+func StreamPrincipal() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextStream{ServerStream: ss, ctx: withPrincipal(ss.Context())})
+	}
+}
+
+func withPrincipal(ctx context.Context) context.Context {
+	if !verifiedPeer(ctx) {
+		return ctx
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	p, ok := principal.FromMetadata(md)
+	if !ok {
+		return ctx
+	}
+
+	return principal.NewContext(ctx, p)
+}
+
+// verifiedPeer reports whether the RPC's peer presented a client certificate
+// that was verified against the client CAs.
+func verifiedPeer(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+
+	return ok && len(tlsInfo.State.VerifiedChains) > 0
+}
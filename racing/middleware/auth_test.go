@@ -0,0 +1,87 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"git.neds.sh/matty/entain/racing/middleware"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// principalStream is a server stream of the given context.
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestPrincipal(t *testing.T) {
+	forwarded := metadata.Pairs(
+		principal.SubjectKey, "alice",
+		principal.MethodKey, "api_key",
+		principal.RolesKey, "trader",
+		principal.RolesKey, "admin",
+	)
+	want := &principal.Principal{Subject: "alice", Method: "api_key", Roles: []string{"trader", "admin"}}
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	verified := credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}}
+
+	for _, tc := range []struct {
+		name string
+		peer *peer.Peer
+		md   metadata.MD
+		// want is the principal read, or nil when the call is anonymous.
+		want *principal.Principal
+	}{
+		{"verified client certificate", &peer.Peer{Addr: addr, AuthInfo: verified}, forwarded, want},
+		{"verified client certificate without a principal", &peer.Peer{Addr: addr, AuthInfo: verified}, metadata.Pairs(principal.RolesKey, "trader"), nil},
+		{"TLS without a client certificate", &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{}}, forwarded, nil},
+		{"plaintext", &peer.Peer{Addr: addr}, forwarded, nil},
+		{"no peer", nil, forwarded, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+			if tc.peer != nil {
+				ctx = peer.NewContext(ctx, tc.peer)
+			}
+
+			check := func(ctx context.Context) {
+				t.Helper()
+
+				got, _ := principal.FromContext(ctx)
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("principal = %+v, want %+v", got, tc.want)
+				}
+			}
+
+			_, err := middleware.UnaryPrincipal()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				check(ctx)
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatalf("UnaryPrincipal: %v", err)
+			}
+
+			err = middleware.StreamPrincipal()(nil, &principalStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+				check(ss.Context())
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("StreamPrincipal: %v", err)
+			}
+		})
+	}
+}
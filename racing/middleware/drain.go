@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// StreamDrain ends every streaming RPC once ctx is done, so long-lived
+// streams, such as race watches, don't hold up a graceful stop.
+func StreamDrain(ctx context.Context) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		streamCtx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-streamCtx.Done():
+			}
+		}()
+
+		return handler(srv, &contextStream{ServerStream: ss, ctx: streamCtx})
+	}
+}
+
+// contextStream overrides a server stream's context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
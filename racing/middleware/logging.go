@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"git.neds.sh/matty/entain/shared/principal"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDKey is the metadata key the gateway sends a request's ID in, so
+// the RPCs made for a request can be correlated with it.
+const RequestIDKey = "x-request-id"
+
+// UnaryLogging logs every unary RPC once it completes.
+func UnaryLogging() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+
+		resp, err := handler(ctx, req)
+		logCall(ctx, info.FullMethod, start, err)
+
+		return resp, err
+	}
+}
+
+// StreamLogging logs every streaming RPC once the stream ends.
+func StreamLogging() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+
+		err := handler(srv, ss)
+		logCall(ss.Context(), info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+// RequestID returns the ID of the request an RPC was made for, or "" if the
+// caller didn't send one.
+func RequestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if ids := md.Get(RequestIDKey); len(ids) > 0 {
+		return ids[0]
+	}
+
+	return ""
+}
+
+func logCall(ctx context.Context, fullMethod string, start time.Time, err error) {
+	code := status.Code(err)
+
+	fields := log.Fields{
+		"grpc.method": fullMethod,
+		"grpc.code":   code.String(),
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		"request_id":  RequestID(ctx),
+	}
+
+	if p, ok := principal.FromContext(ctx); ok {
+		fields["principal"] = p.Subject
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+
+	entry := log.WithFields(fields)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+
+	entry.Log(codeLevel(code), "finished call")
+}
+
+// codeLevel is the level a call's outcome is logged at: errors the caller
+// brought about are routine, while those of the service itself need looking
+// into.
+func codeLevel(code codes.Code) log.Level {
+	switch code {
+	case codes.OK, codes.Canceled, codes.InvalidArgument, codes.NotFound,
+		codes.AlreadyExists, codes.Unauthenticated, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange:
+		return log.InfoLevel
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.Unavailable:
+		return log.WarnLevel
+	default:
+		return log.ErrorLevel
+	}
+}
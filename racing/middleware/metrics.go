@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics records the number, outcome and latency of the RPCs a server
+// handles, per method.
+type ServerMetrics struct {
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewServerMetrics creates the server's metrics, registering them with reg.
+func NewServerMetrics(reg prometheus.Registerer) *ServerMetrics {
+	m := &ServerMetrics{
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Time taken for the server to complete RPCs, in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+	}
+
+	reg.MustRegister(m.handled, m.duration)
+
+	return m
+}
+
+// Unary records the metrics of unary RPCs.
+func (m *ServerMetrics) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+
+		resp, err := handler(ctx, req)
+		m.observe("unary", info.FullMethod, start, err)
+
+		return resp, err
+	}
+}
+
+// Stream records the metrics of streaming RPCs, which last until the stream
+// ends.
+func (m *ServerMetrics) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+
+		err := handler(srv, ss)
+		m.observe(streamType(info), info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+func (m *ServerMetrics) observe(rpcType, fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+
+	m.handled.WithLabelValues(rpcType, service, method, status.Code(err).String()).Inc()
+	m.duration.WithLabelValues(rpcType, service, method).Observe(time.Since(start).Seconds())
+}
+
+// streamType names the kind of a streaming RPC.
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// splitMethod splits a full method name, such as "/racing.Racing/ListRaces",
+// into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+
+	return "unknown", fullMethod
+}
@@ -0,0 +1,26 @@
+// Package middleware provides the gRPC server interceptors the racing service
+// is run with.
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// UnaryTimeout bounds every unary RPC by the given timeout, so work is
+// abandoned once no caller could still be waiting on it. A caller's own,
+// earlier deadline still applies. A timeout of zero or less disables it.
+func UnaryTimeout(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if timeout <= 0 {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return handler(ctx, req)
+	}
+}
@@ -1,31 +1,340 @@
 package service
 
 import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/auth"
 	"git.neds.sh/matty/entain/racing/db"
 	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/shared/principal"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type Racing interface {
 	// ListRaces will return a collection of races.
 	ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error)
+
+	// GetRace will return a single race.
+	GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error)
+
+	// WatchRaces will stream a snapshot of races, followed by changes to them.
+	WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error
+
+	// CreateRace will create a race.
+	CreateRace(ctx context.Context, in *racing.CreateRaceRequest) (*racing.Race, error)
+
+	// UpdateRace will update a race.
+	UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.Race, error)
+
+	// DeleteRace will delete a race.
+	DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*emptypb.Empty, error)
 }
 
 // racingService implements the Racing interface.
 type racingService struct {
 	racesRepo db.RacesRepo
+	policy    *auth.Policy
+	watcher   *watcher
 }
 
-// NewRacingService instantiates and returns a new racingService.
-func NewRacingService(racesRepo db.RacesRepo) Racing {
-	return &racingService{racesRepo}
+// RacingServiceOption configures a racing service.
+type RacingServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	clock func() time.Time
+}
+
+// WithClock overrides the clock watches are filtered by, and wait for races
+// to start by. It should be the clock of the races repository.
+func WithClock(clock func() time.Time) RacingServiceOption {
+	return func(o *serviceOptions) {
+		o.clock = clock
+	}
+}
+
+// NewRacingService instantiates and returns a new racingService, authorizing
+// callers by the given policy.
+func NewRacingService(racesRepo db.RacesRepo, policy *auth.Policy, opts ...RacingServiceOption) Racing {
+	o := serviceOptions{clock: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &racingService{racesRepo, policy, newWatcher(racesRepo, defaultWatchResync, o.clock)}
 }
 
 func (s *racingService) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
-	races, err := s.racesRepo.List(in.Filter)
+	filter, err := s.authorizeFilter(ctx, in.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*racing.ListRacesRequest)
+	req.Filter = filter
+
+	races, nextPageToken, err := s.racesRepo.List(ctx, req)
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	return &racing.ListRacesResponse{Races: races, NextPageToken: nextPageToken}, nil
+}
+
+func (s *racingService) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	race, err := s.racesRepo.Get(ctx, in.Id)
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	// Hidden races are reported as not found, so their existence isn't
+	// revealed either.
+	if !race.Visible && !s.policy.Allows(ctx, auth.ReadHiddenRaces) {
+		return nil, toStatusError(ctx, db.ErrNotFound)
+	}
+
+	return race, nil
+}
+
+func (s *racingService) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	ctx := stream.Context()
+
+	filter, err := s.authorizeFilter(ctx, in.Filter)
 	if err != nil {
+		return err
+	}
+
+	sub := s.watcher.subscribe(filter)
+	defer s.watcher.unsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.done:
+			return toStatusError(ctx, sub.err)
+		case update := <-sub.updates:
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *racingService) CreateRace(ctx context.Context, in *racing.CreateRaceRequest) (*racing.Race, error) {
+	if err := s.authorize(ctx, auth.WriteRaces); err != nil {
+		return nil, err
+	}
+
+	if err := validateRace(in.Race, nil); err != nil {
 		return nil, err
 	}
 
-	return &racing.ListRacesResponse{Races: races}, nil
+	race, err := s.racesRepo.Create(ctx, in.Race)
+	// Failed writes may have been applied regardless, so watches are
+	// notified of them too.
+	s.watcher.notify()
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	return race, nil
+}
+
+func (s *racingService) UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.Race, error) {
+	if err := s.authorize(ctx, auth.WriteRaces); err != nil {
+		return nil, err
+	}
+
+	if in.Race.GetId() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "race.id is required")
+	}
+
+	fields := in.UpdateMask.GetPaths()
+
+	// A mask of "*" is the explicit form of replacing every field.
+	if len(fields) == 1 && fields[0] == "*" {
+		fields = nil
+	}
+
+	if err := validateRace(in.Race, fields); err != nil {
+		return nil, err
+	}
+
+	race, err := s.racesRepo.Update(ctx, in.Race, fields)
+	s.watcher.notify()
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	return race, nil
+}
+
+func (s *racingService) DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx, auth.WriteRaces); err != nil {
+		return nil, err
+	}
+
+	err := s.racesRepo.Delete(ctx, in.Id)
+	s.watcher.notify()
+	if err != nil {
+		return nil, toStatusError(ctx, err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// authorize checks the caller holds the permission, reporting anonymous
+// callers as unauthenticated and others as denied.
+func (s *racingService) authorize(ctx context.Context, perm auth.Permission) error {
+	if s.policy.Allows(ctx, perm) {
+		return nil
+	}
+
+	if _, ok := principal.FromContext(ctx); !ok {
+		return status.Error(codes.Unauthenticated, "authentication required")
+	}
+
+	return status.Errorf(codes.PermissionDenied, "permission %s required", perm)
+}
+
+// authorizeFilter returns the filter a caller's listing is restricted to.
+// Callers who may not see hidden races only ever list visible ones, whatever
+// filter they send, and are refused when asking for hidden races alone.
+func (s *racingService) authorizeFilter(ctx context.Context, filter *racing.ListRacesRequestFilter) (*racing.ListRacesRequestFilter, error) {
+	if s.policy.Allows(ctx, auth.ReadHiddenRaces) {
+		return filter, nil
+	}
+
+	if filter != nil && filter.Visible != nil && !*filter.Visible {
+		return nil, s.authorize(ctx, auth.ReadHiddenRaces)
+	}
+
+	restricted := &racing.ListRacesRequestFilter{}
+	if filter != nil {
+		restricted = proto.Clone(filter).(*racing.ListRacesRequestFilter)
+	}
+
+	visible := true
+	restricted.Visible = &visible
+
+	return restricted, nil
+}
+
+// validateRace checks the given fields of a race being written hold valid
+// values, checking every field when none are given.
+func validateRace(race *racing.Race, fields []string) error {
+	if race == nil {
+		return status.Error(codes.InvalidArgument, "race is required")
+	}
+
+	checked := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		checked[field] = true
+	}
+
+	for _, check := range []struct {
+		field string
+		valid bool
+	}{
+		{"meeting_id", race.MeetingId > 0},
+		{"name", strings.TrimSpace(race.Name) != ""},
+		{"number", race.Number > 0},
+		{"advertised_start_time", race.AdvertisedStartTime.IsValid()},
+	} {
+		if (len(fields) == 0 || checked[check.field]) && !check.valid {
+			return status.Errorf(codes.InvalidArgument, "race.%s is invalid", check.field)
+		}
+	}
+
+	return nil
+}
+
+// listAll returns every race matching the filter, across all pages.
+func listAll(ctx context.Context, racesRepo db.RacesRepo, filter *racing.ListRacesRequestFilter) ([]*racing.Race, error) {
+	var (
+		races []*racing.Race
+		req   = &racing.ListRacesRequest{Filter: filter, PageSize: math.MaxInt32}
+	)
+
+	for {
+		page, nextPageToken, err := racesRepo.List(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		races = append(races, page...)
+
+		if nextPageToken == "" {
+			return races, nil
+		}
+
+		req.PageToken = nextPageToken
+	}
+}
+
+// racesByID indexes races by their ID.
+func racesByID(races []*racing.Race) map[int64]*racing.Race {
+	byID := make(map[int64]*racing.Race, len(races))
+
+	for _, race := range races {
+		byID[race.Id] = race
+	}
+
+	return byID
+}
+
+// diffRaces compares the previously known races against the current ones,
+// returning those that are new or differ, and those that have gone. Changed
+// races keep the order of the current listing.
+func diffRaces(known, current map[int64]*racing.Race, races []*racing.Race) (changed, removed []*racing.Race) {
+	for _, race := range races {
+		if prev, ok := known[race.Id]; !ok || !proto.Equal(prev, race) {
+			changed = append(changed, race)
+		}
+	}
+
+	for id, race := range known {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, race)
+		}
+	}
+
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Id < removed[j].Id })
+
+	return changed, removed
+}
+
+// toStatusError maps repository errors onto the appropriate gRPC status. Any
+// error after the request's context is done is reported as its cancellation
+// or deadline, as the driver may surface it as some other failure.
+func toStatusError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, db.ErrInvalidOrderBy),
+		errors.Is(err, db.ErrInvalidPageSize),
+		errors.Is(err, db.ErrInvalidPageToken),
+		errors.Is(err, db.ErrInvalidUpdateMask):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, db.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, db.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return err
+	}
 }
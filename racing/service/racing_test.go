@@ -0,0 +1,203 @@
+package service_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/auth"
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/service"
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+// Callers of the service: an anonymous one, one holding a role the policy
+// grants nothing, and a trader, granted every permission.
+var (
+	anonymous = context.Background()
+	punter    = principal.NewContext(context.Background(), &principal.Principal{Subject: "bob", Method: "jwt", Roles: []string{"punter"}})
+	trader    = principal.NewContext(context.Background(), &principal.Principal{Subject: "alice", Method: "api_key", Roles: []string{"trader"}})
+)
+
+// Races the service is seeded with: one visible, and one hidden.
+const (
+	visibleRace = 1
+	hiddenRace  = 2
+)
+
+// newService returns a service in front of a memory repository seeded with
+// a visible and a hidden race, authorizing callers by a policy granting
+// traders every permission.
+func newService(t *testing.T) service.Racing {
+	t.Helper()
+
+	start := timestamppb.New(time.Now().Add(time.Hour))
+
+	return newServiceOf(t, time.Now,
+		&racing.Race{Id: visibleRace, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: start},
+		&racing.Race{Id: hiddenRace, MeetingId: 1, Name: "Bravo", Number: 2, Visible: false, AdvertisedStartTime: start},
+	)
+}
+
+// newServiceOf returns a service in front of a memory repository seeded with
+// the given races, both using the clock, authorizing callers by a policy
+// granting traders every permission.
+func newServiceOf(t *testing.T, clock func() time.Time, races ...*racing.Race) service.Racing {
+	t.Helper()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte("roles:\n  trader: [races:read_hidden, races:write]\n  punter: []\n"), 0o600); err != nil {
+		t.Fatalf("writing policy: %v", err)
+	}
+
+	policy, err := auth.LoadPolicy(policyFile)
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+
+	racesRepo := db.NewMemoryRacesRepo(
+		db.WithClock(clock),
+		db.WithSeeder(func() ([]*racing.Race, error) { return races, nil }),
+	)
+	if err := racesRepo.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	return service.NewRacingService(racesRepo, policy, service.WithClock(clock))
+}
+
+// raceIDs returns the IDs of races, in order.
+func raceIDs(races []*racing.Race) []int64 {
+	ids := make([]int64, len(races))
+	for i, race := range races {
+		ids[i] = race.Id
+	}
+	return ids
+}
+
+func TestListRacesAuthorization(t *testing.T) {
+	visible, hidden := true, false
+
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		filter *racing.ListRacesRequestFilter
+		// want is the IDs of the races listed, when code is OK.
+		want []int64
+		code codes.Code
+	}{
+		{"anonymous without a filter", anonymous, nil, []int64{visibleRace}, codes.OK},
+		{"anonymous with an empty filter", anonymous, &racing.ListRacesRequestFilter{}, []int64{visibleRace}, codes.OK},
+		{"anonymous filtering on visible races", anonymous, &racing.ListRacesRequestFilter{Visible: &visible}, []int64{visibleRace}, codes.OK},
+		{"anonymous filtering on hidden races", anonymous, &racing.ListRacesRequestFilter{Visible: &hidden}, nil, codes.Unauthenticated},
+		{"punter without a filter", punter, nil, []int64{visibleRace}, codes.OK},
+		{"punter filtering by meeting", punter, &racing.ListRacesRequestFilter{MeetingIds: []int64{1}}, []int64{visibleRace}, codes.OK},
+		{"punter filtering on hidden races", punter, &racing.ListRacesRequestFilter{Visible: &hidden}, nil, codes.PermissionDenied},
+		{"trader without a filter", trader, nil, []int64{visibleRace, hiddenRace}, codes.OK},
+		{"trader filtering on visible races", trader, &racing.ListRacesRequestFilter{Visible: &visible}, []int64{visibleRace}, codes.OK},
+		{"trader filtering on hidden races", trader, &racing.ListRacesRequestFilter{Visible: &hidden}, []int64{hiddenRace}, codes.OK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := newService(t).ListRaces(tc.ctx, &racing.ListRacesRequest{Filter: tc.filter, OrderBy: "id"})
+
+			if code := status.Code(err); code != tc.code {
+				t.Fatalf("ListRaces = %v, want code %s", err, tc.code)
+			}
+
+			if got := raceIDs(resp.GetRaces()); err == nil && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ListRaces = races %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetRaceAuthorization(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		id   int64
+		code codes.Code
+	}{
+		{"anonymous getting a visible race", anonymous, visibleRace, codes.OK},
+		{"anonymous getting a hidden race", anonymous, hiddenRace, codes.NotFound},
+		{"punter getting a visible race", punter, visibleRace, codes.OK},
+		{"punter getting a hidden race", punter, hiddenRace, codes.NotFound},
+		{"trader getting a hidden race", trader, hiddenRace, codes.OK},
+		{"trader getting a missing race", trader, 99, codes.NotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			race, err := newService(t).GetRace(tc.ctx, &racing.GetRaceRequest{Id: tc.id})
+
+			if code := status.Code(err); code != tc.code {
+				t.Fatalf("GetRace = %v, want code %s", err, tc.code)
+			}
+
+			if err == nil && race.Id != tc.id {
+				t.Errorf("GetRace = race %d, want %d", race.Id, tc.id)
+			}
+		})
+	}
+}
+
+func TestWriteRacesAuthorization(t *testing.T) {
+	newRace := func() *racing.Race {
+		return &racing.Race{MeetingId: 2, Name: "Charlie", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(time.Now().Add(time.Hour))}
+	}
+
+	writes := []struct {
+		name  string
+		write func(ctx context.Context, s service.Racing) error
+	}{
+		{"create", func(ctx context.Context, s service.Racing) error {
+			_, err := s.CreateRace(ctx, &racing.CreateRaceRequest{Race: newRace()})
+			return err
+		}},
+		{"update", func(ctx context.Context, s service.Racing) error {
+			_, err := s.UpdateRace(ctx, &racing.UpdateRaceRequest{Race: &racing.Race{Id: visibleRace, Name: "Delta"}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"name"}}})
+			return err
+		}},
+		{"delete", func(ctx context.Context, s service.Racing) error {
+			_, err := s.DeleteRace(ctx, &racing.DeleteRaceRequest{Id: visibleRace})
+			return err
+		}},
+	}
+
+	for _, caller := range []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"anonymous", anonymous, codes.Unauthenticated},
+		{"punter", punter, codes.PermissionDenied},
+		{"trader", trader, codes.OK},
+	} {
+		for _, w := range writes {
+			t.Run(caller.name+" "+w.name, func(t *testing.T) {
+				s := newService(t)
+
+				if err := w.write(caller.ctx, s); status.Code(err) != caller.code {
+					t.Fatalf("%s = %v, want code %s", w.name, err, caller.code)
+				}
+
+				// Refused writes leave the races as they were.
+				resp, err := s.ListRaces(trader, &racing.ListRacesRequest{OrderBy: "id"})
+				if err != nil {
+					t.Fatalf("ListRaces: %v", err)
+				}
+
+				if caller.code != codes.OK && (len(resp.Races) != 2 || resp.Races[0].Version != 1) {
+					t.Errorf("races after a refused %s = %v, want them unchanged", w.name, resp.Races)
+				}
+			})
+		}
+	}
+}
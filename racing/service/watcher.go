@@ -0,0 +1,263 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultWatchResync is the longest watched races go without being listed
+// again. Writes made through this service are seen straight away, and status
+// changes as races start, but writes made by other processes sharing the
+// database are only seen when listing again.
+const defaultWatchResync = 30 * time.Second
+
+// watchBuffer is how many updates a watch may fall behind by before it's
+// ended, so one slow watcher can't hold up the rest.
+const watchBuffer = 16
+
+// errWatchBehind ends a watch that fell too far behind.
+var errWatchBehind = status.Error(codes.ResourceExhausted, "watch fell behind the changes to races")
+
+// watcher lists races on behalf of every watch, rather than each watch
+// listing them itself. It lists every race when notified of a write, when the
+// next race starts, and at least every resync, and fans out the changes to
+// each watch, by its filter. It only runs while there are watches.
+type watcher struct {
+	racesRepo db.RacesRepo
+	resync    time.Duration
+	clock     func() time.Time
+
+	// wake holds a pending request to list races again.
+	wake chan struct{}
+
+	mu            sync.Mutex
+	subscriptions map[*subscription]bool
+	// stop ends the running watcher, and is nil when it isn't running.
+	stop context.CancelFunc
+}
+
+// subscription is a watch of the races selected by a filter.
+type subscription struct {
+	filter  *racing.ListRacesRequestFilter
+	updates chan *racing.WatchRacesResponse
+	// done is closed when the watcher ends the subscription, after setting
+	// err to why.
+	done chan struct{}
+	err  error
+	// known holds the races last sent, by ID, and is nil until the snapshot
+	// is sent.
+	known map[int64]*racing.Race
+}
+
+func newWatcher(racesRepo db.RacesRepo, resync time.Duration, clock func() time.Time) *watcher {
+	return &watcher{
+		racesRepo:     racesRepo,
+		resync:        resync,
+		clock:         clock,
+		wake:          make(chan struct{}, 1),
+		subscriptions: make(map[*subscription]bool),
+	}
+}
+
+// subscribe starts watching the races selected by the filter. The first
+// update is a snapshot of them.
+func (w *watcher) subscribe(filter *racing.ListRacesRequestFilter) *subscription {
+	sub := &subscription{
+		filter:  filter,
+		updates: make(chan *racing.WatchRacesResponse, watchBuffer),
+		done:    make(chan struct{}),
+	}
+
+	w.mu.Lock()
+	w.subscriptions[sub] = true
+
+	if w.stop == nil {
+		var ctx context.Context
+		ctx, w.stop = context.WithCancel(context.Background())
+
+		go w.run(ctx)
+	}
+	w.mu.Unlock()
+
+	// Races are listed again for the snapshot, so it's current.
+	w.notify()
+
+	return sub
+}
+
+// unsubscribe stops a watch, stopping the watcher when it was the last.
+func (w *watcher) unsubscribe(sub *subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.subscriptions, sub)
+	w.stopIfIdle()
+}
+
+// notify has the watcher list races again, as they may have been written.
+func (w *watcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run lists races whenever woken, until the context ends.
+func (w *watcher) run(ctx context.Context) {
+	timer := time.NewTimer(w.resync)
+	defer timer.Stop()
+
+	var known map[int64]*racing.Race
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+
+		now := w.clock()
+		races, err := listAll(ctx, w.racesRepo, nil)
+
+		w.mu.Lock()
+
+		// Once stopped, a new watcher may already be serving the
+		// subscriptions.
+		if ctx.Err() != nil {
+			w.mu.Unlock()
+			return
+		}
+
+		if err != nil {
+			for sub := range w.subscriptions {
+				w.end(sub, err)
+			}
+
+			w.stopIfIdle()
+			w.mu.Unlock()
+
+			return
+		}
+
+		current := racesByID(races)
+		changed, removed := diffRaces(known, current, races)
+		known = current
+
+		for sub := range w.subscriptions {
+			w.publish(sub, races, changed, removed, now)
+		}
+
+		w.stopIfIdle()
+		w.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(w.nextListing(races, now))
+	}
+}
+
+// nextListing returns how long until races should be listed again: when the
+// next of them starts, and its status changes, but no later than the resync.
+func (w *watcher) nextListing(races []*racing.Race, now time.Time) time.Duration {
+	next := w.resync
+
+	for _, race := range races {
+		if untilStart := race.AdvertisedStartTime.AsTime().Sub(now); untilStart > 0 && untilStart < next {
+			next = untilStart
+		}
+	}
+
+	return next
+}
+
+// publish sends a subscription the changes to the races it watches: a
+// snapshot of all of them, when it has yet to be sent one, or the races that
+// are new to it or changed, and those that have gone or no longer match its
+// filter.
+func (w *watcher) publish(sub *subscription, races, changed, removed []*racing.Race, now time.Time) {
+	if sub.known == nil {
+		var snapshot []*racing.Race
+
+		for _, race := range races {
+			if db.MatchesFilter(race, sub.filter, now) {
+				snapshot = append(snapshot, race)
+			}
+		}
+
+		sub.known = racesByID(snapshot)
+		w.send(sub, &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_SNAPSHOT, Races: snapshot})
+
+		return
+	}
+
+	var subChanged, subRemoved []*racing.Race
+
+	for _, race := range changed {
+		if db.MatchesFilter(race, sub.filter, now) {
+			subChanged = append(subChanged, race)
+			sub.known[race.Id] = race
+		} else if prev, ok := sub.known[race.Id]; ok {
+			subRemoved = append(subRemoved, prev)
+			delete(sub.known, race.Id)
+		}
+	}
+
+	for _, race := range removed {
+		if prev, ok := sub.known[race.Id]; ok {
+			subRemoved = append(subRemoved, prev)
+			delete(sub.known, race.Id)
+		}
+	}
+
+	sort.Slice(subRemoved, func(i, j int) bool { return subRemoved[i].Id < subRemoved[j].Id })
+
+	if len(subChanged) > 0 {
+		w.send(sub, &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_CHANGED, Races: subChanged})
+	}
+
+	if len(subRemoved) > 0 {
+		w.send(sub, &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_REMOVED, Races: subRemoved})
+	}
+}
+
+// send queues an update for a subscription, ending it if it has fallen too
+// far behind to queue any more.
+func (w *watcher) send(sub *subscription, update *racing.WatchRacesResponse) {
+	if _, ok := w.subscriptions[sub]; !ok {
+		return
+	}
+
+	select {
+	case sub.updates <- update:
+	default:
+		w.end(sub, errWatchBehind)
+	}
+}
+
+// end ends a subscription with the given error.
+func (w *watcher) end(sub *subscription, err error) {
+	sub.err = err
+	close(sub.done)
+	delete(w.subscriptions, sub)
+}
+
+// stopIfIdle stops the watcher when there are no subscriptions left. It must
+// be called with mu held.
+func (w *watcher) stopIfIdle() {
+	if len(w.subscriptions) == 0 && w.stop != nil {
+		w.stop()
+		w.stop = nil
+	}
+}
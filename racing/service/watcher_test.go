@@ -0,0 +1,241 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/service"
+)
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// watchStream is the server side of a watch, passing the updates sent on to
+// its channel.
+type watchStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	updates chan *racing.WatchRacesResponse
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Send(update *racing.WatchRacesResponse) error {
+	select {
+	case s.updates <- update:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// watch starts watching the races selected by the filter in the background,
+// as the caller of ctx, until the test ends. The stream buffers the given
+// number of updates, blocking the watch when full, and the watch's result is
+// sent to the channel returned.
+func watch(t *testing.T, s service.Racing, ctx context.Context, filter *racing.ListRacesRequestFilter, buffer int) (*watchStream, <-chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	stream := &watchStream{ctx: ctx, updates: make(chan *racing.WatchRacesResponse, buffer)}
+	result := make(chan error, 1)
+
+	go func() {
+		result <- s.WatchRaces(&racing.WatchRacesRequest{Filter: filter}, stream)
+	}()
+
+	return stream, result
+}
+
+// expect waits for the next update of the stream, which should be of the
+// given type and hold the races with the given IDs, returning its races.
+func expect(t *testing.T, stream *watchStream, typ racing.WatchRacesResponse_Type, ids ...int64) []*racing.Race {
+	t.Helper()
+
+	select {
+	case update := <-stream.updates:
+		if got := raceIDs(update.Races); update.Type != typ || !reflect.DeepEqual(got, ids) {
+			t.Fatalf("update = %s of races %v, want %s of races %v", update.Type, got, typ, ids)
+		}
+
+		return update.Races
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no update, want %s of races %v", typ, ids)
+		return nil
+	}
+}
+
+func TestWatchRaces(t *testing.T) {
+	clock := newFakeClock()
+	start := timestamppb.New(clock.Now().Add(time.Hour))
+
+	s := newServiceOf(t, clock.Now,
+		&racing.Race{Id: visibleRace, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: start},
+		&racing.Race{Id: hiddenRace, MeetingId: 1, Name: "Bravo", Number: 2, Visible: false, AdvertisedStartTime: start},
+	)
+
+	// Anonymous callers only ever watch visible races, while traders watch
+	// them all.
+	public, _ := watch(t, s, anonymous, nil, 16)
+	all, _ := watch(t, s, trader, nil, 16)
+
+	expect(t, public, racing.WatchRacesResponse_SNAPSHOT, visibleRace)
+	expect(t, all, racing.WatchRacesResponse_SNAPSHOT, visibleRace, hiddenRace)
+
+	created, err := s.CreateRace(trader, &racing.CreateRaceRequest{Race: &racing.Race{MeetingId: 1, Name: "Charlie", Number: 3, Visible: true, AdvertisedStartTime: start}})
+	if err != nil {
+		t.Fatalf("CreateRace: %v", err)
+	}
+
+	expect(t, public, racing.WatchRacesResponse_CHANGED, created.Id)
+	expect(t, all, racing.WatchRacesResponse_CHANGED, created.Id)
+
+	update := func(race *racing.Race, fields ...string) {
+		t.Helper()
+
+		if _, err := s.UpdateRace(trader, &racing.UpdateRaceRequest{Race: race, UpdateMask: &fieldmaskpb.FieldMask{Paths: fields}}); err != nil {
+			t.Fatalf("UpdateRace: %v", err)
+		}
+	}
+
+	update(&racing.Race{Id: visibleRace, Name: "Delta"}, "name")
+
+	if races := expect(t, public, racing.WatchRacesResponse_CHANGED, visibleRace); races[0].Name != "Delta" || races[0].Version != 2 {
+		t.Errorf("changed race = %v, want it renamed Delta, at version 2", races[0])
+	}
+	expect(t, all, racing.WatchRacesResponse_CHANGED, visibleRace)
+
+	// Hiding a race removes it from anonymous watches.
+	update(&racing.Race{Id: visibleRace, Visible: false}, "visible")
+
+	expect(t, public, racing.WatchRacesResponse_REMOVED, visibleRace)
+	expect(t, all, racing.WatchRacesResponse_CHANGED, visibleRace)
+
+	if _, err := s.DeleteRace(trader, &racing.DeleteRaceRequest{Id: created.Id}); err != nil {
+		t.Fatalf("DeleteRace: %v", err)
+	}
+
+	expect(t, public, racing.WatchRacesResponse_REMOVED, created.Id)
+	expect(t, all, racing.WatchRacesResponse_REMOVED, created.Id)
+
+	// Updates of races a watch doesn't select aren't sent to it.
+	update(&racing.Race{Id: hiddenRace, Name: "Echo"}, "name")
+
+	expect(t, all, racing.WatchRacesResponse_CHANGED, hiddenRace)
+
+	select {
+	case update := <-public.updates:
+		t.Errorf("anonymous watch sent %s of races %v, want nothing", update.Type, raceIDs(update.Races))
+	default:
+	}
+}
+
+func TestWatchRacesStatusChange(t *testing.T) {
+	// The race starts a moment after the watches do, on the second, as
+	// start times are stored, so the watcher lists races again then, and
+	// keeps doing so until the clock is moved past it.
+	clock := newFakeClock()
+	clock.Advance(-time.Millisecond)
+
+	s := newServiceOf(t, clock.Now,
+		&racing.Race{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(clock.Now().Add(time.Millisecond))},
+		&racing.Race{Id: 2, MeetingId: 1, Name: "Bravo", Number: 2, Visible: true, AdvertisedStartTime: timestamppb.New(clock.Now().Add(time.Hour))},
+	)
+
+	all, _ := watch(t, s, anonymous, nil, 16)
+	open, _ := watch(t, s, anonymous, &racing.ListRacesRequestFilter{Statuses: []racing.Race_Status{racing.Race_OPEN}}, 16)
+
+	expect(t, all, racing.WatchRacesResponse_SNAPSHOT, 1, 2)
+	expect(t, open, racing.WatchRacesResponse_SNAPSHOT, 1, 2)
+
+	clock.Advance(time.Minute)
+
+	if races := expect(t, all, racing.WatchRacesResponse_CHANGED, 1); races[0].Status != racing.Race_CLOSED {
+		t.Errorf("changed race has status %s, want CLOSED", races[0].Status)
+	}
+	expect(t, open, racing.WatchRacesResponse_REMOVED, 1)
+}
+
+func TestWatchRacesSlowWatch(t *testing.T) {
+	clock := newFakeClock()
+
+	s := newServiceOf(t, clock.Now,
+		&racing.Race{Id: 1, MeetingId: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(clock.Now().Add(time.Hour))},
+	)
+
+	// The slow watch takes its snapshot, then no more updates, so is held up
+	// sending the next.
+	slow, slowResult := watch(t, s, anonymous, nil, 0)
+	fast, fastResult := watch(t, s, anonymous, nil, 16)
+
+	expect(t, slow, racing.WatchRacesResponse_SNAPSHOT, 1)
+	expect(t, fast, racing.WatchRacesResponse_SNAPSHOT, 1)
+
+	// Each update is seen by the fast watch before the next is made, so
+	// each is sent to both watches separately, more than the slow watch
+	// can fall behind by.
+	for i := 0; i < 20; i++ {
+		if _, err := s.UpdateRace(trader, &racing.UpdateRaceRequest{Race: &racing.Race{Id: 1, Name: fmt.Sprint("Alpha ", i)}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"name"}}}); err != nil {
+			t.Fatalf("UpdateRace: %v", err)
+		}
+
+		expect(t, fast, racing.WatchRacesResponse_CHANGED, 1)
+	}
+
+	// The slow watch ends once it takes its updates, as it fell behind.
+	for done := false; !done; {
+		select {
+		case <-slow.updates:
+		case err := <-slowResult:
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("slow watch = %v, want code ResourceExhausted", err)
+			}
+			done = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("slow watch never ended")
+		}
+	}
+
+	// While the fast watch carries on.
+	select {
+	case err := <-fastResult:
+		t.Fatalf("fast watch = %v, want it to carry on", err)
+	default:
+	}
+}
@@ -0,0 +1,142 @@
+// Package certs loads the TLS certificates and CAs the services are
+// configured with. Certificates and CAs are reloaded when their files change,
+// so they can be rotated without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KeyPair is a certificate and its key, reloaded from their files when either
+// changes. Should a reload fail, such as while the files are part way through
+// being replaced, the previous certificate is kept.
+type KeyPair struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// LoadKeyPair loads a PEM encoded certificate and key.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{certFile: certFile, keyFile: keyFile}
+
+	if _, err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Certificate returns the current certificate.
+func (k *KeyPair) Certificate() *tls.Certificate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if reloaded, err := k.reload(); err != nil {
+		log.Warnf("failed reloading certificate %s, keeping the previous one: %s", k.certFile, err)
+	} else if reloaded {
+		log.Infof("reloaded certificate %s", k.certFile)
+	}
+
+	return k.cert
+}
+
+// reload loads the certificate if its files changed since it was last
+// loaded, reporting whether it was.
+func (k *KeyPair) reload() (bool, error) {
+	var modTimes [2]time.Time
+
+	for i, file := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	if k.cert != nil && modTimes == k.modTimes {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	k.cert, k.modTimes = &cert, modTimes
+
+	return true, nil
+}
+
+// CAPool is a pool of CA certificates, reloaded from its file when it
+// changes. Should a reload fail, the previous pool is kept.
+type CAPool struct {
+	file string
+
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// LoadCAPool loads a file of PEM encoded CA certificates.
+func LoadCAPool(file string) (*CAPool, error) {
+	p := &CAPool{file: file}
+
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Pool returns the current pool.
+func (p *CAPool) Pool() *x509.CertPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if reloaded, err := p.reload(); err != nil {
+		log.Warnf("failed reloading CA certificates %s, keeping the previous ones: %s", p.file, err)
+	} else if reloaded {
+		log.Infof("reloaded CA certificates %s", p.file)
+	}
+
+	return p.pool
+}
+
+// reload loads the pool if its file changed since it was last loaded,
+// reporting whether it was.
+func (p *CAPool) reload() (bool, error) {
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return false, err
+	}
+
+	if p.pool != nil && info.ModTime().Equal(p.modTime) {
+		return false, nil
+	}
+
+	pem, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return false, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return false, fmt.Errorf("no certificates found in %s", p.file)
+	}
+
+	p.pool, p.modTime = pool, info.ModTime()
+
+	return true, nil
+}
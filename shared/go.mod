@@ -0,0 +1,14 @@
+module git.neds.sh/matty/entain/shared
+
+go 1.16
+
+require (
+	github.com/sirupsen/logrus v1.8.1
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	google.golang.org/grpc v1.41.0
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
+	golang.org/x/text v0.3.5 // indirect
+	google.golang.org/genproto v0.0.0-20210226172003-ab064af71705 // indirect
+)
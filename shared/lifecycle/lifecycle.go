@@ -0,0 +1,58 @@
+// Package lifecycle runs the parts of the services that surround serving
+// their callers: the admin endpoints, and shutting down on a signal.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeAdmin serves the admin endpoints in the background, until the server
+// returned is closed. They're served apart from the endpoints callers use, so
+// they needn't be exposed alongside them. Metrics are served at /metrics by
+// the handler given, e.g. promhttp.Handler().
+func ServeAdmin(endpoint string, metrics http.Handler) (*http.Server, error) {
+	conn, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("failed serving admin endpoints: %s", err)
+		}
+	}()
+
+	log.Infof("admin server listening on: %s", endpoint)
+
+	return server, nil
+}
+
+// ShutdownContext returns a copy of parent that's done once the process is
+// interrupted or terminated, for it to shut down. The default handling of
+// the signals is restored then, so a second signal kills the process rather
+// than waiting on the shutdown, such as while draining connections. Calling
+// stop restores it too.
+func ShutdownContext(parent context.Context) (ctx context.Context, stop context.CancelFunc) {
+	ctx, stop = signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return ctx, stop
+}
@@ -0,0 +1,59 @@
+package lifecycle_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"git.neds.sh/matty/entain/shared/lifecycle"
+)
+
+func TestServeAdmin(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	endpoint := lis.Addr().String()
+	lis.Close()
+
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metrics")
+	})
+
+	server, err := lifecycle.ServeAdmin(endpoint, metrics)
+	if err != nil {
+		t.Fatalf("ServeAdmin: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/metrics", http.StatusOK, "metrics"},
+		{"/", http.StatusNotFound, ""},
+		{"/debug/pprof/", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get("http://" + endpoint + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.code || (tc.body != "" && string(body) != tc.body) {
+			t.Errorf("GET %s = %d %q, want %d %q", tc.path, resp.StatusCode, body, tc.code, tc.body)
+		}
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := http.Get("http://" + endpoint + "/metrics"); err == nil {
+		t.Error("GET /metrics after Close succeeded, want it refused")
+	}
+}
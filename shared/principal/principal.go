@@ -0,0 +1,70 @@
+// Package principal holds the caller a request is made for, as the API
+// gateway authenticated them. The gateway forwards the principal to the
+// services as gRPC metadata, which the services read it back from.
+package principal
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys the principal is forwarded in.
+const (
+	SubjectKey = "x-principal-subject"
+	MethodKey  = "x-principal-method"
+	RolesKey   = "x-principal-roles"
+)
+
+// MetadataPrefix prefixes every metadata key the principal is forwarded in.
+const MetadataPrefix = "x-principal-"
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject identifies the caller: a token's subject, or an API key's name.
+	Subject string
+	// Method is how the caller authenticated, e.g. "jwt" or "api_key".
+	Method string
+	// Roles are the roles the caller holds.
+	Roles []string
+}
+
+// contextKey is the context key of a request's principal.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal ctx carries, if any. Requests from
+// anonymous callers have none.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+
+	return p, ok
+}
+
+// Metadata encodes the principal as metadata, for forwarding.
+func (p *Principal) Metadata() metadata.MD {
+	md := metadata.Pairs(SubjectKey, p.Subject, MethodKey, p.Method)
+	md.Append(RolesKey, p.Roles...)
+
+	return md
+}
+
+// FromMetadata decodes the principal forwarded in md, if any.
+func FromMetadata(md metadata.MD) (*Principal, bool) {
+	subjects := md.Get(SubjectKey)
+	if len(subjects) == 0 || subjects[0] == "" {
+		return nil, false
+	}
+
+	p := &Principal{Subject: subjects[0], Roles: md.Get(RolesKey)}
+
+	if methods := md.Get(MethodKey); len(methods) > 0 {
+		p.Method = methods[0]
+	}
+
+	return p, true
+}
@@ -0,0 +1,53 @@
+package principal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	"git.neds.sh/matty/entain/shared/principal"
+)
+
+func TestMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    *principal.Principal
+	}{
+		{"roles", &principal.Principal{Subject: "alice", Method: "jwt", Roles: []string{"trader", "admin"}}},
+		{"no roles", &principal.Principal{Subject: "trading-desk", Method: "api_key"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := principal.FromMetadata(tc.p.Metadata())
+			if !ok {
+				t.Fatalf("FromMetadata(%v) found no principal", tc.p.Metadata())
+			}
+
+			if !reflect.DeepEqual(got, tc.p) {
+				t.Errorf("FromMetadata = %+v, want %+v", got, tc.p)
+			}
+		})
+	}
+}
+
+func TestFromMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		md   metadata.MD
+		// want is the principal read, or nil when there's none.
+		want *principal.Principal
+	}{
+		{"none", metadata.MD{}, nil},
+		{"empty subject", metadata.Pairs(principal.SubjectKey, "", principal.RolesKey, "trader"), nil},
+		{"roles without a subject", metadata.Pairs(principal.RolesKey, "trader"), nil},
+		{"no method", metadata.Pairs(principal.SubjectKey, "alice"), &principal.Principal{Subject: "alice"}},
+		{"many subjects", metadata.Pairs(principal.SubjectKey, "alice", principal.SubjectKey, "bob"), &principal.Principal{Subject: "alice"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := principal.FromMetadata(tc.md)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("FromMetadata = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Package tracing sets up OpenTelemetry tracing for the services.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Config configures how trace spans are exported. Each service's
+// configuration holds the same fields, so converts to it.
+type Config struct {
+	// Exporter is none, otlp, stdout or file.
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector spans are sent to over
+	// gRPC, for the otlp exporter.
+	Endpoint string
+	// Insecure sends spans to the collector in plaintext.
+	Insecure bool
+	// File is the file spans are appended to, for the file exporter.
+	File string
+	// SampleRatio is the fraction of new traces sampled, from 0 to 1. Traces
+	// begun by a caller follow the caller's sampling decision.
+	SampleRatio float64
+}
+
+// ShutdownFunc flushes any spans not yet exported, and stops exporting.
+type ShutdownFunc func(ctx context.Context) error
+
+// Init installs the global tracer provider, exporting the spans of the named
+// service as configured, and the W3C trace context propagator. The returned
+// function must be called before exiting, so buffered spans aren't lost.
+func Init(ctx context.Context, cfg Config, service string) (ShutdownFunc, error) {
+	// Trace context is propagated even when spans aren't exported, so traces
+	// passing through the service stay whole.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.Exporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(service),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+
+		if closer != nil {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+
+		return err
+	}, nil
+}
+
+// newExporter creates the configured exporter, along with the file it writes
+// to, if any, which must be closed once it's shut down.
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+
+		exporter, err := otlptracegrpc.New(ctx, opts...)
+		return exporter, nil, err
+	case "stdout":
+		return newWriterExporter(os.Stdout), nil, nil
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return newWriterExporter(f), f, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+}
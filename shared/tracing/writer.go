@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// writerExporter writes spans as lines of JSON, for local use.
+type writerExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// writtenSpan is the JSON form spans are written in.
+type writtenSpan struct {
+	Service      string                 `json:"service"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Start        time.Time              `json:"start"`
+	Duration     string                 `json:"duration"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func newWriterExporter(w io.Writer) *writerExporter {
+	return &writerExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *writerExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, span := range spans {
+		written := writtenSpan{
+			Name:     span.Name(),
+			Kind:     span.SpanKind().String(),
+			TraceID:  span.SpanContext().TraceID().String(),
+			SpanID:   span.SpanContext().SpanID().String(),
+			Start:    span.StartTime(),
+			Duration: span.EndTime().Sub(span.StartTime()).String(),
+			Status:   span.Status().Code.String(),
+			Error:    span.Status().Description,
+		}
+
+		if span.Parent().IsValid() {
+			written.ParentSpanID = span.Parent().SpanID().String()
+		}
+
+		if service, ok := span.Resource().Set().Value(semconv.ServiceNameKey); ok {
+			written.Service = service.AsString()
+		}
+
+		if attrs := span.Attributes(); len(attrs) > 0 {
+			written.Attributes = make(map[string]interface{}, len(attrs))
+
+			for _, attr := range attrs {
+				written.Attributes[string(attr.Key)] = attr.Value.AsInterface()
+			}
+		}
+
+		if err := e.enc.Encode(written); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *writerExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"syreclabs.com/go/faker"
+)
+
+// sportCompetitions lists the competitions seeded for each sport.
+var sportCompetitions = map[string][]string{
+	"Soccer":       {"Premier League", "A-League", "La Liga"},
+	"Basketball":   {"NBA", "NBL"},
+	"Rugby League": {"NRL", "Super League"},
+	"AFL":          {"AFL Premiership"},
+	"Cricket":      {"Big Bash League", "Sheffield Shield"},
+}
+
+func (r *eventsRepo) seed() error {
+	if _, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS events (id INTEGER PRIMARY KEY, name TEXT, sport TEXT, competition TEXT, home_team TEXT, away_team TEXT, visible INTEGER, advertised_start_time DATETIME)`); err != nil {
+		return err
+	}
+
+	sports := make([]string, 0, len(sportCompetitions))
+	for sport := range sportCompetitions {
+		sports = append(sports, sport)
+	}
+	sort.Strings(sports)
+
+	statement, err := r.db.Prepare(`INSERT OR IGNORE INTO events(id, name, sport, competition, home_team, away_team, visible, advertised_start_time) VALUES (?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	for i := 1; i <= 100; i++ {
+		sport := faker.RandomChoice(sports)
+		homeTeam, awayTeam := faker.Team().Name(), faker.Team().Name()
+
+		if _, err := statement.Exec(
+			i,
+			homeTeam+" vs "+awayTeam,
+			sport,
+			faker.RandomChoice(sportCompetitions[sport]),
+			homeTeam,
+			awayTeam,
+			faker.Number().Between(0, 1),
+			faker.Time().Between(time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 2)).Format(time.RFC3339),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
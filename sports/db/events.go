@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	_ "github.com/mattn/go-sqlite3"
+
+	"git.neds.sh/matty/entain/sports/proto/sports"
+)
+
+// EventsRepo provides repository access to sports events.
+type EventsRepo interface {
+	// Init will initialise our events repository.
+	Init() error
+
+	// List will return a list of events matching the filter, sorted by the
+	// given AIP-132 order_by expression.
+	List(filter *sports.ListEventsRequestFilter, orderBy string) ([]*sports.Event, error)
+}
+
+type eventsRepo struct {
+	db   *sql.DB
+	init sync.Once
+}
+
+// NewEventsRepo creates a new events repository.
+func NewEventsRepo(db *sql.DB) EventsRepo {
+	return &eventsRepo{db: db}
+}
+
+// Init prepares the events repository dummy data.
+func (r *eventsRepo) Init() error {
+	var err error
+
+	r.init.Do(func() {
+		// For test/example purposes, we seed the DB with some dummy events.
+		err = r.seed()
+	})
+
+	return err
+}
+
+func (r *eventsRepo) List(filter *sports.ListEventsRequestFilter, orderBy string) ([]*sports.Event, error) {
+	var (
+		err   error
+		query string
+		args  []interface{}
+	)
+
+	order, err := parseOrderBy(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	query = getEventQueries()[eventsList]
+
+	query, args = r.applyFilter(query, filter)
+
+	query += orderClause(order)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.scanEvents(rows)
+}
+
+func (r *eventsRepo) applyFilter(query string, filter *sports.ListEventsRequestFilter) (string, []interface{}) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	if filter == nil {
+		return query, args
+	}
+
+	if len(filter.Sports) > 0 {
+		clauses = append(clauses, "sport IN ("+strings.Repeat("?,", len(filter.Sports)-1)+"?)")
+
+		for _, sport := range filter.Sports {
+			args = append(args, sport)
+		}
+	}
+
+	if filter.Visible != nil {
+		clauses = append(clauses, "visible = ?")
+		args = append(args, filter.GetVisible())
+	}
+
+	if len(clauses) != 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	return query, args
+}
+
+func (r *eventsRepo) scanEvents(
+	rows *sql.Rows,
+) ([]*sports.Event, error) {
+	defer rows.Close()
+
+	var events []*sports.Event
+
+	for rows.Next() {
+		var event sports.Event
+		var advertisedStart time.Time
+
+		if err := rows.Scan(&event.Id, &event.Name, &event.Sport, &event.Competition, &event.HomeTeam, &event.AwayTeam, &event.Visible, &advertisedStart); err != nil {
+			return nil, err
+		}
+
+		ts, err := ptypes.TimestampProto(advertisedStart)
+		if err != nil {
+			return nil, err
+		}
+
+		event.AdvertisedStartTime = ts
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
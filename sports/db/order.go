@@ -0,0 +1,92 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// defaultEventsOrderBy is applied when the caller doesn't specify an ordering.
+const defaultEventsOrderBy = "advertised_start_time"
+
+// ErrInvalidOrderBy is returned when an order_by expression can't be parsed
+// or references a field that isn't sortable.
+var ErrInvalidOrderBy = errors.New("invalid order_by")
+
+// eventOrderColumns whitelists the fields events may be sorted by, mapping each
+// public field name to the SQL expression used to sort it. Caller input is
+// only ever used as a key into this map, never placed into the query itself.
+var eventOrderColumns = map[string]string{
+	"id":                    "id",
+	"name":                  "name",
+	"sport":                 "sport",
+	"competition":           "competition",
+	"visible":               "visible",
+	"advertised_start_time": "datetime(advertised_start_time)",
+}
+
+// orderField is a single, validated term of an order_by expression.
+type orderField struct {
+	field string
+	desc  bool
+}
+
+// parseOrderBy parses an AIP-132 style order_by expression, such as
+// "sport, advertised_start_time desc", into its validated terms.
+func parseOrderBy(orderBy string) ([]orderField, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		orderBy = defaultEventsOrderBy
+	}
+
+	var (
+		fields []orderField
+		seen   = make(map[string]bool)
+	)
+
+	for _, term := range strings.Split(orderBy, ",") {
+		parts := strings.Fields(term)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("%w: malformed term %q", ErrInvalidOrderBy, strings.TrimSpace(term))
+		}
+
+		field := orderField{field: parts[0]}
+		if _, ok := eventOrderColumns[field.field]; !ok {
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidOrderBy, field.field)
+		}
+
+		if seen[field.field] {
+			return nil, fmt.Errorf("%w: field %q specified more than once", ErrInvalidOrderBy, field.field)
+		}
+		seen[field.field] = true
+
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case "asc":
+			case "desc":
+				field.desc = true
+			default:
+				return nil, fmt.Errorf("%w: unknown direction %q for field %q", ErrInvalidOrderBy, parts[1], field.field)
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// orderClause renders validated order fields as an ORDER BY clause.
+func orderClause(fields []orderField) string {
+	terms := make([]string, 0, len(fields))
+
+	for _, f := range fields {
+		term := eventOrderColumns[f.field]
+		if f.desc {
+			term += " DESC"
+		}
+
+		terms = append(terms, term)
+	}
+
+	return " ORDER BY " + strings.Join(terms, ", ")
+}
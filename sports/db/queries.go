@@ -0,0 +1,22 @@
+package db
+
+const (
+	eventsList = "list"
+)
+
+func getEventQueries() map[string]string {
+	return map[string]string{
+		eventsList: `
+			SELECT 
+				id, 
+				name, 
+				sport, 
+				competition, 
+				home_team, 
+				away_team, 
+				visible, 
+				advertised_start_time 
+			FROM events
+		`,
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"net"
+
+	"git.neds.sh/matty/entain/sports/db"
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"git.neds.sh/matty/entain/sports/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9001", "gRPC server endpoint")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatalf("failed running grpc server: %s\n", err)
+	}
+}
+
+func run() error {
+	conn, err := net.Listen("tcp", *grpcEndpoint)
+	if err != nil {
+		return err
+	}
+
+	sportsDB, err := sql.Open("sqlite3", "./db/sports.db")
+	if err != nil {
+		return err
+	}
+
+	eventsRepo := db.NewEventsRepo(sportsDB)
+	if err := eventsRepo.Init(); err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+
+	sports.RegisterSportsServer(
+		grpcServer,
+		service.NewSportsService(
+			eventsRepo,
+		),
+	)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
+	log.Printf("gRPC server listening on: %s\n", *grpcEndpoint)
+
+	if err := grpcServer.Serve(conn); err != nil {
+		return err
+	}
+
+	return nil
+}
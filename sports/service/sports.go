@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+
+	"git.neds.sh/matty/entain/sports/db"
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Sports interface {
+	// ListEvents will return a collection of events.
+	ListEvents(ctx context.Context, in *sports.ListEventsRequest) (*sports.ListEventsResponse, error)
+}
+
+// sportsService implements the Sports interface.
+type sportsService struct {
+	eventsRepo db.EventsRepo
+}
+
+// NewSportsService instantiates and returns a new sportsService.
+func NewSportsService(eventsRepo db.EventsRepo) Sports {
+	return &sportsService{eventsRepo}
+}
+
+func (s *sportsService) ListEvents(ctx context.Context, in *sports.ListEventsRequest) (*sports.ListEventsResponse, error) {
+	events, err := s.eventsRepo.List(in.Filter, in.OrderBy)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &sports.ListEventsResponse{Events: events}, nil
+}
+
+// toStatusError maps repository errors onto the appropriate gRPC status.
+func toStatusError(err error) error {
+	switch {
+	case errors.Is(err, db.ErrInvalidOrderBy):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return err
+	}
+}